@@ -0,0 +1,67 @@
+package filelock
+
+import (
+	"errors"
+	"os"
+)
+
+var (
+	ErrRangeUnsupported = errors.New("lock backend does not support byte ranges")
+	ErrProbeUnsupported = errors.New("lock backend cannot query lock holders")
+	ErrWouldBlock       = errors.New("lock is held by others")
+)
+
+// Flock is a lock request on a byte range of a lock file, or a lock held by others
+// as reported by a Backend. It mirrors the fcntl flock structure in portable terms.
+type Flock struct {
+	Mode  Mode  // Mode is the mode requested or held, Unlocked to release the range
+	Start int64 // Start is the offset of the first byte
+	Len   int64 // Len is the number of bytes, zero for every byte from Start on
+	Pid   int   // Pid is the process holding a reported lock, -1 or 0 if unknown
+}
+
+// Backend is a mechanism for applying locks to an open lock file.
+//
+// The backends of the platform are the POSIX record locks used by default, and
+// those selected with WithOFD and WithFlock where the platform supports them. On
+// platforms without any, New and the functions that query lock files fail with
+// ErrUnsupported. WithBackend plugs in another Backend, such as a FakeBackend.
+//
+// A lock held by others conflicts with a request when their byte ranges overlap
+// and either of them is exclusive. The last bytes of the offset space, past any
+// range a caller can lock, are used by the FileLock for its own bookkeeping, such
+// as the intent to upgrade a shared lock.
+type Backend interface {
+	// SetLock applies lock to file, replacing the locks already held through file
+	// on its bytes. If wait is true, SetLock waits until the lock no longer
+	// conflicts with locks held by others; otherwise it fails immediately, with
+	// an error matching ErrWouldBlock, EAGAIN or EACCES.
+	SetLock(file *os.File, lock *Flock, wait bool) error
+
+	// GetLock reports the first lock held by others that conflicts with lock,
+	// by overwriting lock with it, or sets its mode to Unlocked if there is none.
+	// Backends that cannot tell return ErrProbeUnsupported.
+	GetLock(file *os.File, lock *Flock) error
+
+	// Ranges reports whether the backend can lock byte ranges smaller than the
+	// whole file.
+	Ranges() bool
+
+	// Interruptible reports whether a waiting SetLock is a system call that a
+	// signal interrupts with EINTR. The waits of other backends are polled.
+	Interruptible() bool
+}
+
+// WithBackend returns an Option that makes the FileLock apply its locks with b
+// instead of classic POSIX record locks.
+//
+// The backend is fixed for the lifetime of the FileLock, so WithBackend only takes
+// effect when passed to New.
+func WithBackend(b Backend) Option {
+	return func(c *config) { c.backend = b }
+}
+
+// contended reports whether err means that a lock is held by others.
+func contended(err error) bool {
+	return errors.Is(err, ErrWouldBlock) || busy(err)
+}
@@ -0,0 +1,10 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package filelock
+
+// The platform supports none of the lock backends, so New fails with
+// ErrUnsupported.
+var (
+	posixBackend Backend
+	flockBackend Backend
+)
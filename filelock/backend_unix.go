@@ -0,0 +1,108 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package filelock
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fcntlBackend applies fcntl record locks with a pair of set commands.
+type fcntlBackend struct {
+	getlk  int // get the first conflicting lock
+	setlk  int // set a lock, failing if it conflicts
+	setlkw int // set a lock, waiting until it does not conflict
+}
+
+// posixBackend uses classic POSIX record locks, which are owned by the process.
+var posixBackend Backend = fcntlBackend{getlk: unix.F_GETLK, setlk: unix.F_SETLK, setlkw: unix.F_SETLKW}
+
+func (b fcntlBackend) SetLock(file *os.File, lock *Flock, wait bool) error {
+	cmd := b.setlk
+	if wait {
+		cmd = b.setlkw
+	}
+	fl := toFcntl(lock)
+	return unix.FcntlFlock(file.Fd(), cmd, &fl)
+}
+
+func (b fcntlBackend) GetLock(file *os.File, lock *Flock) error {
+	fl := toFcntl(lock)
+	if err := unix.FcntlFlock(file.Fd(), b.getlk, &fl); err != nil {
+		return err
+	}
+	*lock = Flock{Mode: modeOf(fl.Type), Start: fl.Start, Len: fl.Len, Pid: int(fl.Pid)}
+	return nil
+}
+
+func (b fcntlBackend) Ranges() bool        { return true }
+func (b fcntlBackend) Interruptible() bool { return true }
+
+// toFcntl returns lock as an fcntl flock structure.
+func toFcntl(lock *Flock) unix.Flock_t {
+	return unix.Flock_t{
+		Type:   typeOf(lock.Mode), // F_RDLCK, F_WRLCK or F_UNLCK
+		Whence: io.SeekStart,      // relative to the start of the file
+		Start:  lock.Start,        // lock starts at byte offset
+		Len:    lock.Len,          // lock covers length bytes
+	}
+}
+
+// typeOf maps a Mode to the fcntl lock type that represents it.
+func typeOf(m Mode) int16 {
+	switch m {
+	case Shared:
+		return unix.F_RDLCK
+	case Exclusive:
+		return unix.F_WRLCK
+	default:
+		return unix.F_UNLCK
+	}
+}
+
+// modeOf maps an fcntl lock type to the Mode it represents.
+func modeOf(typ int16) Mode {
+	switch typ {
+	case unix.F_RDLCK:
+		return Shared
+	case unix.F_WRLCK:
+		return Exclusive
+	default:
+		return Unlocked
+	}
+}
+
+// flockBackend uses flock(2) locks, which are owned by the open file description
+// and always cover the whole file.
+var flockBackend Backend = flockLocks{}
+
+type flockLocks struct{}
+
+func (flockLocks) SetLock(file *os.File, lock *Flock, wait bool) error {
+	if lock.Start != 0 || lock.Len != maxOffset {
+		return ErrRangeUnsupported
+	}
+
+	var how int
+	switch lock.Mode {
+	case Shared:
+		how = unix.LOCK_SH
+	case Exclusive:
+		how = unix.LOCK_EX
+	default:
+		how = unix.LOCK_UN
+	}
+	if !wait {
+		how |= unix.LOCK_NB
+	}
+	return unix.Flock(int(file.Fd()), how)
+}
+
+func (flockLocks) GetLock(*os.File, *Flock) error {
+	return ErrProbeUnsupported
+}
+
+func (flockLocks) Ranges() bool        { return false }
+func (flockLocks) Interruptible() bool { return true }
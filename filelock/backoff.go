@@ -0,0 +1,157 @@
+package filelock
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	minWaitDuration = 200 * time.Millisecond
+	maxWaitDuration = 600 * time.Millisecond
+)
+
+var (
+	// defaultBackoff waits a random delay between minWaitDuration and maxWaitDuration.
+	defaultBackoff Backoff = uniformBackoff{min: minWaitDuration, max: maxWaitDuration}
+
+	// fallbackWaitBackoff polls quickly for locks acquired with WithBlock, and with
+	// WithKernelWait where the wait in the kernel cannot be interrupted.
+	fallbackWaitBackoff = ExponentialBackoff(time.Millisecond, 50*time.Millisecond)
+)
+
+// Backoff decides how long to wait between attempts to acquire a lock that is
+// not available.
+type Backoff interface {
+	// Next returns the delay to wait after the given failed attempt, counted
+	// from 1. prev is the delay Next returned for the previous attempt, or 0
+	// after the first one.
+	Next(attempt int, prev time.Duration) time.Duration
+}
+
+// ConstantBackoff returns a Backoff that always waits d.
+func ConstantBackoff(d time.Duration) Backoff {
+	return uniformBackoff{min: d, max: d}
+}
+
+// ExponentialBackoff returns a Backoff that doubles the delay after every attempt,
+// starting from base and capped at maxDelay. Each delay is jittered down by up to
+// half, so that contending processes drift apart instead of retrying in lockstep.
+func ExponentialBackoff(base, maxDelay time.Duration) Backoff {
+	return exponentialBackoff{base: base, max: maxDelay}
+}
+
+// DecorrelatedBackoff returns a Backoff that picks every delay at random between
+// base and three times the previous delay, capped at maxDelay. It spreads out
+// contending processes more evenly than ExponentialBackoff.
+func DecorrelatedBackoff(base, maxDelay time.Duration) Backoff {
+	return decorrelatedBackoff{base: base, max: maxDelay}
+}
+
+// Rand is a source of random numbers, which jitters the delays of the built-in
+// Backoff policies. It is shared by the lock operations using it, so it must be
+// safe for concurrent use; a *rand.Rand of math/rand is not. The default draws
+// from the concurrency-safe global source of math/rand/v2.
+type Rand interface {
+	// Int63n returns a random number in [0, n). It is only called with n > 0.
+	Int63n(n int64) int64
+}
+
+// WithRand returns an Option that makes the built-in Backoff policies draw their
+// delays from r instead of the default source, so that a test can make them
+// reproducible. Custom Backoff policies are not affected.
+func WithRand(r Rand) Option {
+	return func(c *config) { c.rand = r }
+}
+
+// systemRand is the Rand of the global source of math/rand/v2.
+type systemRand struct{}
+
+func (systemRand) Int63n(n int64) int64 { return rand.Int64N(n) }
+
+// randomBackoff is a built-in Backoff, whose delays are drawn from a Rand.
+type randomBackoff interface {
+	Backoff
+	next(r Rand, attempt int, prev time.Duration) time.Duration
+}
+
+// nextDelay returns the delay to wait after the given failed attempt with b,
+// drawn from the Rand of c if b is a built-in policy.
+func (c *config) nextDelay(b Backoff, attempt int, prev time.Duration) time.Duration {
+	if rb, ok := b.(randomBackoff); ok {
+		return rb.next(c.rand, attempt, prev)
+	}
+	return b.Next(attempt, prev)
+}
+
+// Stats are counters of the acquisitions made by a FileLock.
+//
+// An attempt is one try at taking the lock, so a lock that was free takes a
+// single attempt. Locks acquired with WithKernelWait count one attempt
+// when the wait runs in the kernel.
+type Stats struct {
+	Acquisitions uint64 // Acquisitions is the number of locks acquired
+	Failures     uint64 // Failures is the number of acquisitions that gave up
+	Attempts     uint64 // Attempts is the total number of attempts made
+	LastAttempts int    // LastAttempts is the number of attempts of the latest acquisition
+}
+
+// record counts an acquisition that took the given number of attempts.
+func (s *Stats) record(attempts int, acquired bool) {
+	if acquired {
+		s.Acquisitions++
+	} else {
+		s.Failures++
+	}
+	s.Attempts += uint64(attempts)
+	s.LastAttempts = attempts
+}
+
+type uniformBackoff struct {
+	min, max time.Duration
+}
+
+func (b uniformBackoff) Next(attempt int, prev time.Duration) time.Duration {
+	return b.next(systemRand{}, attempt, prev)
+}
+
+func (b uniformBackoff) next(r Rand, _ int, _ time.Duration) time.Duration {
+	return randomDuration(r, b.min, b.max)
+}
+
+type exponentialBackoff struct {
+	base, max time.Duration
+}
+
+func (b exponentialBackoff) Next(attempt int, prev time.Duration) time.Duration {
+	return b.next(systemRand{}, attempt, prev)
+}
+
+func (b exponentialBackoff) next(r Rand, attempt int, _ time.Duration) time.Duration {
+	d := b.max
+	if shift := attempt - 1; shift < 62 && b.base < b.max>>shift {
+		d = b.base << shift
+	}
+	return randomDuration(r, d-d/2, d)
+}
+
+type decorrelatedBackoff struct {
+	base, max time.Duration
+}
+
+func (b decorrelatedBackoff) Next(attempt int, prev time.Duration) time.Duration {
+	return b.next(systemRand{}, attempt, prev)
+}
+
+func (b decorrelatedBackoff) next(r Rand, _ int, prev time.Duration) time.Duration {
+	prev = max(prev, b.base)
+	return min(randomDuration(r, b.base, prev*3), b.max)
+}
+
+// randomDuration returns a random duration in [minDuration, maxDuration) drawn
+// from r, or minDuration if the interval is empty.
+func randomDuration(r Rand, minDuration, maxDuration time.Duration) time.Duration {
+	if maxDuration <= minDuration {
+		return minDuration
+	}
+	return minDuration + time.Duration(r.Int63n(int64(maxDuration-minDuration)))
+}
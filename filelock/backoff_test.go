@@ -0,0 +1,78 @@
+package filelock
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	require.Equal(t, 50*time.Millisecond, ConstantBackoff(50*time.Millisecond).Next(3, 0))
+
+	exp := ExponentialBackoff(10*time.Millisecond, time.Second)
+	for attempt, want := range map[int]time.Duration{
+		1:  10 * time.Millisecond,
+		2:  20 * time.Millisecond,
+		4:  80 * time.Millisecond,
+		10: time.Second,
+		99: time.Second,
+	} {
+		d := exp.Next(attempt, 0)
+		require.GreaterOrEqual(t, d, want/2, "attempt %d", attempt)
+		require.LessOrEqual(t, d, want, "attempt %d", attempt)
+	}
+
+	dec := DecorrelatedBackoff(10*time.Millisecond, 100*time.Millisecond)
+	var prev time.Duration
+	for attempt := 1; attempt < 50; attempt++ {
+		d := dec.Next(attempt, prev)
+		require.GreaterOrEqual(t, d, 10*time.Millisecond)
+		require.LessOrEqual(t, d, 100*time.Millisecond)
+		require.LessOrEqual(t, d, max(prev, 10*time.Millisecond)*3)
+		prev = d
+	}
+}
+
+// zeroRand is a Rand that always draws the lowest number.
+type zeroRand struct{}
+
+func (zeroRand) Int63n(int64) int64 { return 0 }
+
+// backoffFunc is a custom Backoff.
+type backoffFunc func(attempt int, prev time.Duration) time.Duration
+
+func (f backoffFunc) Next(attempt int, prev time.Duration) time.Duration { return f(attempt, prev) }
+
+func TestWithRand(t *testing.T) {
+	// The built-in policies draw from the Rand, custom ones do not.
+	c := newConfig([]Option{WithRand(zeroRand{})})
+	require.Equal(t, minWaitDuration, c.nextDelay(defaultBackoff, 1, 0))
+	require.Equal(t, 40*time.Millisecond, c.nextDelay(ExponentialBackoff(10*time.Millisecond, time.Second), 4, 0))
+	require.Equal(t, 10*time.Millisecond, c.nextDelay(DecorrelatedBackoff(10*time.Millisecond, time.Second), 5, 50*time.Millisecond))
+	custom := backoffFunc(func(int, time.Duration) time.Duration { return 7 * time.Millisecond })
+	require.Equal(t, 7*time.Millisecond, c.nextDelay(custom, 1, 0))
+
+	// An acquisition on virtual time retries after the drawn delay.
+	file := filepath.Join(t.TempDir(), "target")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	fake := NewFakeBackend()
+	l, err := New(file, WithBackend(fake), WithClock(clock), WithRand(zeroRand{}))
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.NoError(t, fake.Hold(file, Holder{PID: 42, Mode: Exclusive}, 0, 0))
+	errC := make(chan error, 1)
+	go func() { errC <- l.WLock(WithTimeout(time.Minute)) }()
+	clock.BlockUntil(2) // the timeout and the first backoff delay
+	require.NoError(t, fake.Release(file, 42))
+	clock.Advance(minWaitDuration)
+	require.NoError(t, <-errC)
+
+	h, err := l.Holder()
+	require.NoError(t, err)
+	require.True(t, h.Acquired.Equal(start.Add(minWaitDuration)), h.Acquired)
+	require.NoError(t, l.Unlock())
+}
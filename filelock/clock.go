@@ -0,0 +1,100 @@
+package filelock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits for it to pass, for the timeouts and backoff of
+// lock acquisitions. The default is the system clock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel that receives the current time once d has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// WithClock returns an Option that makes the lock operation tell time with clk
+// instead of the system clock, such as a FakeClock driven by a test.
+func WithClock(clk Clock) Option {
+	return func(c *config) { c.clock = clk }
+}
+
+// systemClock is the Clock of package time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// FakeClock is a Clock on virtual time, which only passes when Advance is called.
+// Its zero value is not usable; create one with NewFakeClock.
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []fakeTimer
+}
+
+// fakeTimer is a channel of a FakeClock waiting for its time to come.
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// NewFakeClock returns a FakeClock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), c: ch})
+	c.cond.Broadcast()
+	return ch
+}
+
+// Advance moves the clock forward by d, firing the channels whose time has come.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+// BlockUntil waits until at least n channels returned by After are waiting for
+// their time to come, which tells a test that the lock calls it started are
+// waiting. Channels nobody receives from any more count until they fire.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
@@ -0,0 +1,326 @@
+package filelock
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deadlockCheckInterval is how often a waiter blocked in the kernel looks for a
+// cycle in the wait-for graph.
+const deadlockCheckInterval = 100 * time.Millisecond
+
+// WithDeadlockDetection returns an Option that makes waiters look for deadlocks in a
+// wait-for graph shared by the processes using dir.
+//
+// Every process records in dir the locks it holds and the ones it waits for, in a
+// file named after its PID. A waiter that finds a cycle of processes waiting for
+// each other, leading back to itself, fails with a *DeadlockError naming the cycle,
+// which matches ErrDeadlock. The cycle must be seen twice in a row, so that a lock
+// released by a process that has not yet recorded it does not fail its waiters.
+//
+// Locks are tracked per lock file: a byte range counts as a lock on the whole file,
+// so processes holding disjoint ranges may be reported as deadlocked. The records of
+// processes that exited are removed by the next waiter that comes across them.
+//
+// Independently of this option, a deadlock the kernel detects while waiting with
+// WithKernelWait is reported as a *DeadlockError too, without the cycle.
+func WithDeadlockDetection(dir string) Option {
+	return func(c *config) { c.graph = graphFor(dir) }
+}
+
+// WaitEdge is a step of a deadlock cycle: a process waiting for a lock held by
+// another one.
+type WaitEdge struct {
+	PID    int    // PID is the waiting process
+	Path   string // Path is the target path of the lock waited for
+	Holder int    // Holder is the process holding the lock
+}
+
+// DeadlockError reports processes waiting for locks held by each other. It matches
+// ErrDeadlock with errors.Is, and unix.EDEADLK when the kernel detected it.
+type DeadlockError struct {
+	Cycle []WaitEdge // Cycle starts with the calling process, nil if unknown
+	Cause error      // Cause is the error of the kernel, nil if none
+}
+
+func (e *DeadlockError) Error() string {
+	if len(e.Cycle) == 0 {
+		return fmt.Sprintf("%v: %v", ErrDeadlock, e.Cause)
+	}
+
+	steps := make([]string, len(e.Cycle))
+	for i, s := range e.Cycle {
+		steps[i] = fmt.Sprintf("pid %d waits for %s held by pid %d", s.PID, s.Path, s.Holder)
+	}
+	return fmt.Sprintf("%v: %s", ErrDeadlock, strings.Join(steps, ", "))
+}
+
+func (e *DeadlockError) Unwrap() []error {
+	if e.Cause == nil {
+		return []error{ErrDeadlock}
+	}
+	return []error{ErrDeadlock, e.Cause}
+}
+
+// graphLock is a lock held or waited for, as recorded in the wait-for graph.
+type graphLock struct {
+	Lock string `json:"lock"` // Lock identifies the lock file by device and inode
+	Path string `json:"path"` // Path is the target path of the lock
+	Mode Mode   `json:"mode"`
+}
+
+// graphRecord is the record of a process in the wait-for graph.
+type graphRecord struct {
+	PID   int         `json:"pid"`
+	Holds []graphLock `json:"holds,omitempty"`
+	Waits []graphLock `json:"waits,omitempty"`
+}
+
+// waitGraph is the part of a wait-for graph that the calling process records.
+type waitGraph struct {
+	dir string
+
+	mu    sync.Mutex
+	holds map[*FileLock]graphLock
+	waits map[*FileLock]graphLock
+}
+
+// graphs are the wait-for graphs used by the process, by directory.
+var graphs = struct {
+	mu sync.Mutex
+	m  map[string]*waitGraph
+}{m: make(map[string]*waitGraph)}
+
+// graphFor returns the wait-for graph of the process in dir.
+func graphFor(dir string) *waitGraph {
+	graphs.mu.Lock()
+	defer graphs.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	g, ok := graphs.m[dir]
+	if !ok {
+		g = &waitGraph{
+			dir:   dir,
+			holds: make(map[*FileLock]graphLock),
+			waits: make(map[*FileLock]graphLock),
+		}
+		graphs.m[dir] = g
+	}
+	return g
+}
+
+// set records that l holds or waits for lk, as selected by m, or that it no longer
+// does if lk is nil.
+func (g *waitGraph) set(m map[*FileLock]graphLock, l *FileLock, lk *graphLock) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if lk == nil {
+		if _, ok := m[l]; !ok {
+			return
+		}
+		delete(m, l)
+	} else {
+		if m[l] == *lk {
+			return
+		}
+		m[l] = *lk
+	}
+
+	// The graph is only a hint for deadlock detection, so failing to record it
+	// does not fail the lock operation.
+	_ = g.save()
+}
+
+// save writes the record of the process, removing it once empty.
+// The caller must hold g.mu.
+func (g *waitGraph) save() error {
+	name := filepath.Join(g.dir, strconv.Itoa(os.Getpid())+".json")
+	if len(g.holds) == 0 && len(g.waits) == 0 {
+		return os.Remove(name)
+	}
+
+	rec := graphRecord{PID: os.Getpid()}
+	for _, lk := range g.holds {
+		rec.Holds = append(rec.Holds, lk)
+	}
+	for _, lk := range g.waits {
+		rec.Waits = append(rec.Waits, lk)
+	}
+	data, err := json.Marshal(&rec)
+	if err != nil {
+		return err
+	}
+
+	// Replace the record in one go, so that readers never see it half written.
+	if err := os.MkdirAll(g.dir, 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(name+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// load reads the records of the live processes in the graph, removing those of
+// processes that exited.
+func (g *waitGraph) load() ([]graphRecord, error) {
+	entries, err := os.ReadDir(g.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []graphRecord
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		name := filepath.Join(g.dir, entry.Name())
+		if exited(pid) {
+			_ = os.Remove(name)
+			continue
+		}
+
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		var rec graphRecord
+		if json.Unmarshal(data, &rec) != nil || rec.PID != pid {
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// cycle looks for a cycle of processes that starts with the calling process waiting
+// for w and leads back to it, returning its steps or nil if there is none.
+func (g *waitGraph) cycle(w graphLock) ([]WaitEdge, error) {
+	records, err := g.load()
+	if err != nil {
+		return nil, err
+	}
+
+	self := os.Getpid()
+	visited := map[int]bool{self: true}
+	var walk func(pid int, w graphLock, path []WaitEdge) []WaitEdge
+	walk = func(pid int, w graphLock, path []WaitEdge) []WaitEdge {
+		for _, rec := range records {
+			if rec.PID == pid || !slices.ContainsFunc(rec.Holds, func(h graphLock) bool {
+				return h.Lock == w.Lock && (h.Mode == Exclusive || w.Mode == Exclusive)
+			}) {
+				continue
+			}
+
+			path := append(path[:len(path):len(path)], WaitEdge{PID: pid, Path: w.Path, Holder: rec.PID})
+			if rec.PID == self {
+				return path
+			}
+			if visited[rec.PID] {
+				continue
+			}
+			visited[rec.PID] = true
+			for _, next := range rec.Waits {
+				if c := walk(rec.PID, next, path); c != nil {
+					return c
+				}
+			}
+		}
+		return nil
+	}
+	return walk(self, w, nil), nil
+}
+
+// graphLock describes a lock of l in mode for the wait-for graph.
+// The caller must hold l.mu.
+func (l *FileLock) graphLock(mode Mode) (*graphLock, error) {
+	fi, err := l.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	key := keyOf(fi)
+	return &graphLock{Lock: fmt.Sprintf("%d:%d", key.dev, key.ino), Path: l.path, Mode: mode}, nil
+}
+
+// syncGraph records the locks held by l in its wait-for graph, if any, after the
+// bookkeeping changed. The caller must hold l.mu.
+func (l *FileLock) syncGraph() {
+	if l.graph == nil {
+		return
+	}
+
+	if len(l.ranges) == 0 || l.file == nil {
+		l.graph.set(l.graph.holds, l, nil)
+		l.graph = nil
+		return
+	}
+
+	held := Unlocked
+	for _, e := range l.ranges {
+		held = max(held, e.mode)
+	}
+	if lk, err := l.graphLock(held); err == nil {
+		l.graph.set(l.graph.holds, l, lk)
+	}
+}
+
+// waitCheck tracks the wait of an acquisition in the wait-for graph.
+type waitCheck struct {
+	g       *waitGraph
+	l       *FileLock
+	w       *graphLock
+	waiting bool
+	seen    int // seen counts the checks in a row that found a cycle
+}
+
+// newWaitCheck returns the waitCheck of an acquisition of lock by a call configured
+// with c, or nil if the call does not detect deadlocks. The caller must hold l.mu.
+func (l *FileLock) newWaitCheck(c *config, lock Flock) *waitCheck {
+	if c.graph == nil {
+		return nil
+	}
+	w, err := l.graphLock(lock.Mode)
+	if err != nil {
+		return nil
+	}
+	return &waitCheck{g: c.graph, l: l, w: w}
+}
+
+// check records the wait in the graph on first use, and fails with a *DeadlockError
+// once a cycle has been found twice in a row.
+func (wc *waitCheck) check() error {
+	if wc == nil {
+		return nil
+	}
+	if !wc.waiting {
+		wc.g.set(wc.g.waits, wc.l, wc.w)
+		wc.waiting = true
+	}
+
+	cycle, err := wc.g.cycle(*wc.w)
+	if err != nil || cycle == nil {
+		wc.seen = 0
+		return nil
+	}
+	if wc.seen++; wc.seen < 2 {
+		return nil
+	}
+	return &DeadlockError{Cycle: cycle}
+}
+
+// done removes the wait from the graph.
+func (wc *waitCheck) done() {
+	if wc == nil || !wc.waiting {
+		return
+	}
+	wc.g.set(wc.g.waits, wc.l, nil)
+}
@@ -0,0 +1,106 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package filelock
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestFileLock_deadlock(t *testing.T) {
+	for _, block := range []bool{false, true} {
+		t.Run(map[bool]string{false: "poll", true: "kernel"}[block], func(t *testing.T) {
+			dir := t.TempDir()
+			graph := filepath.Join(dir, "graph")
+			a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+
+			l, err := New(a, WithDeadlockDetection(graph))
+			require.NoError(t, err)
+			require.NoError(t, l.WLock())
+			other, err := New(b)
+			require.NoError(t, err)
+			defer other.Close()
+
+			// The helper holds b and, as its record claims, waits for a.
+			helper := startHelper(t, "wlock", b, "--hold=2s").Process.Pid
+			writeRecord(t, graph, graphRecord{
+				PID:   helper,
+				Holds: []graphLock{recordLock(t, b, Exclusive)},
+				Waits: []graphLock{recordLock(t, a, Exclusive)},
+			})
+
+			// The record of an exited process is dropped.
+			exited := exec.Command("true")
+			require.NoError(t, exited.Run())
+			writeRecord(t, graph, graphRecord{PID: exited.Process.Pid, Holds: []graphLock{recordLock(t, a, Shared)}})
+
+			opts := []Option{WithTimeout(5 * time.Second)}
+			if block {
+				opts = append(opts, WithKernelWait())
+			}
+			start := time.Now()
+			err = other.WLock(append(opts, WithDeadlockDetection(graph))...)
+			require.ErrorIs(t, err, ErrDeadlock)
+			require.Less(t, time.Since(start), 3*time.Second)
+
+			var deadlockErr *DeadlockError
+			require.ErrorAs(t, err, &deadlockErr)
+			require.Equal(t, []WaitEdge{
+				{PID: os.Getpid(), Path: b, Holder: helper},
+				{PID: helper, Path: a, Holder: os.Getpid()},
+			}, deadlockErr.Cycle)
+			require.NoFileExists(t, filepath.Join(graph, strconv.Itoa(exited.Process.Pid)+".json"))
+
+			// The record of the process goes away with its last lock.
+			require.FileExists(t, filepath.Join(graph, strconv.Itoa(os.Getpid())+".json"))
+			require.NoError(t, l.Unlock())
+			require.NoFileExists(t, filepath.Join(graph, strconv.Itoa(os.Getpid())+".json"))
+		})
+	}
+}
+
+func TestFileLock_deadlockKernel(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+
+	l, err := New(a)
+	require.NoError(t, err)
+	require.NoError(t, l.WLock())
+	other, err := New(b)
+	require.NoError(t, err)
+	defer other.Close()
+
+	// The helper holds b and waits in the kernel for a.
+	startHelper(t, "wlock", b, "--then="+a, "--kernel", "--hold=0s")
+	time.Sleep(200 * time.Millisecond)
+
+	err = other.WLock(WithKernelWait(), WithTimeout(5*time.Second))
+	require.ErrorIs(t, err, ErrDeadlock)
+	require.ErrorIs(t, err, unix.EDEADLK)
+	require.NoError(t, l.Unlock())
+}
+
+// recordLock returns the graph lock of path in mode.
+func recordLock(t *testing.T, path string, mode Mode) graphLock {
+	fi, err := os.Stat(path + ".lock")
+	require.NoError(t, err)
+	key := keyOf(fi)
+	return graphLock{Lock: fmt.Sprintf("%d:%d", key.dev, key.ino), Path: path, Mode: mode}
+}
+
+// writeRecord writes rec in the wait-for graph in dir, as another process would.
+func writeRecord(t *testing.T, dir string, rec graphRecord) {
+	data, err := json.Marshal(&rec)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(dir, 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, strconv.Itoa(rec.PID)+".json"), data, 0o600))
+}
@@ -0,0 +1,61 @@
+package filelock
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// LockError records a failed lock operation and its cause.
+//
+// The cause is matched by errors.Is and errors.As: ErrTimeout when the lock was not
+// acquired in time, along with the error of the last attempt if any, the context
+// error when the context was done first, a *DeadlockError matching ErrDeadlock when
+// waiting would never end, and the unix.Errno of a failed system call, such as
+// EAGAIN or EACCES for a lock held by others.
+type LockError struct {
+	Op     string  // Op is the operation that failed, such as "WLock"
+	Path   string  // Path is the target path of the lock
+	Mode   Mode    // Mode is the mode requested, Unlocked for releases
+	Cause  error   // Cause is the reason of the failure
+	Holder *Holder // Holder is the conflicting holder on timeout, nil if unknown
+}
+
+func (e *LockError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Op)
+	if e.Path != "" {
+		fmt.Fprintf(&b, " %s", e.Path)
+	}
+	if e.Mode != Unlocked {
+		fmt.Fprintf(&b, " (%s)", e.Mode)
+	}
+	fmt.Fprintf(&b, ": %v", e.Cause)
+	if e.Holder != nil {
+		fmt.Fprintf(&b, ": held by %s", e.Holder)
+	}
+	return b.String()
+}
+
+func (e *LockError) Unwrap() error { return e.Cause }
+
+// lockError returns err as a *LockError of the operation op on path in mode, or nil
+// if err is nil. A *LockError is completed rather than wrapped again, so that the
+// holder found on timeout is kept.
+func lockError(op, path string, mode Mode, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var le *LockError
+	if errors.As(err, &le) {
+		if le.Op == "" {
+			le.Op, le.Mode = op, mode
+		}
+		if le.Path == "" {
+			le.Path = path
+		}
+		return err
+	}
+	return &LockError{Op: op, Path: path, Mode: mode, Cause: err}
+}
@@ -0,0 +1,100 @@
+package filelock
+
+import (
+	"expvar"
+	"strconv"
+	"time"
+)
+
+// histogramBounds are the upper bounds of the histogram buckets of ExpvarObserver.
+var histogramBounds = []time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+	time.Minute,
+}
+
+// ExpvarObserver is an Observer that publishes lock events as expvar variables,
+// which are served in JSON by the /debug/vars handler of net/http if the program
+// registers one.
+//
+// The published map holds the counters attempts, contentions, acquisitions, timeouts,
+// cancellations and releases, and the histograms wait_seconds, of the time waited
+// for acquired locks, and hold_seconds, of the time locks were held. A histogram is
+// a map of cumulative bucket counts keyed by upper bound in seconds, as "le_0.001",
+// along with the total "count" and "sum" of the durations in seconds.
+type ExpvarObserver struct {
+	attempts      expvar.Int
+	contentions   expvar.Int
+	acquisitions  expvar.Int
+	timeouts      expvar.Int
+	cancellations expvar.Int
+	releases      expvar.Int
+	wait          histogram
+	hold          histogram
+}
+
+// NewExpvarObserver returns an ExpvarObserver publishing its variables in an expvar
+// map under name. Like expvar.Publish, it panics if name is already in use.
+func NewExpvarObserver(name string) *ExpvarObserver {
+	o := &ExpvarObserver{}
+	o.wait.init()
+	o.hold.init()
+
+	m := expvar.NewMap(name)
+	m.Set("attempts", &o.attempts)
+	m.Set("contentions", &o.contentions)
+	m.Set("acquisitions", &o.acquisitions)
+	m.Set("timeouts", &o.timeouts)
+	m.Set("cancellations", &o.cancellations)
+	m.Set("releases", &o.releases)
+	m.Set("wait_seconds", &o.wait.vars)
+	m.Set("hold_seconds", &o.hold.vars)
+	return o
+}
+
+func (o *ExpvarObserver) Attempt(Event)    { o.attempts.Add(1) }
+func (o *ExpvarObserver) Contention(Event) { o.contentions.Add(1) }
+func (o *ExpvarObserver) Timeout(Event)    { o.timeouts.Add(1) }
+func (o *ExpvarObserver) Cancelled(Event)  { o.cancellations.Add(1) }
+
+func (o *ExpvarObserver) Acquired(e Event) {
+	o.acquisitions.Add(1)
+	o.wait.observe(e.Wait)
+}
+
+func (o *ExpvarObserver) Released(e Event) {
+	o.releases.Add(1)
+	o.hold.observe(e.Wait)
+}
+
+// histogram counts durations in the buckets of histogramBounds.
+type histogram struct {
+	vars    expvar.Map
+	buckets []*expvar.Int
+	count   expvar.Int
+	sum     expvar.Float
+}
+
+func (h *histogram) init() {
+	h.vars.Init()
+	for _, bound := range histogramBounds {
+		v := new(expvar.Int)
+		h.buckets = append(h.buckets, v)
+		h.vars.Set("le_"+strconv.FormatFloat(bound.Seconds(), 'g', -1, 64), v)
+	}
+	h.vars.Set("count", &h.count)
+	h.vars.Set("sum", &h.sum)
+}
+
+func (h *histogram) observe(d time.Duration) {
+	for i, bound := range histogramBounds {
+		if d <= bound {
+			h.buckets[i].Add(1)
+		}
+	}
+	h.count.Add(1)
+	h.sum.Add(d.Seconds())
+}
@@ -0,0 +1,218 @@
+package filelock
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// FakeBackend is an in-memory Backend for unit tests, which simulates other
+// processes contending for locks without spawning them. Its zero value is not
+// usable; create one with NewFakeBackend and pass it to New with WithBackend.
+//
+// Every lock file opened by a FileLock owns its locks, as with open file
+// description locks, so FileLock values sharing a FakeBackend exclude each other
+// even within the test process. Hold simulates another process holding a lock,
+// and Fail makes lock requests fail. Waits are polled, so a FakeClock passed with
+// WithClock drives the timeouts and backoff of the acquisitions.
+type FakeBackend struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	owners []*fakeOwner
+	fail   error
+}
+
+// fakeOwner holds locks on a lock file, through an open file or as a simulated
+// process.
+type fakeOwner struct {
+	file *os.File    // file is the open lock file, nil for a simulated process
+	fi   os.FileInfo // fi identifies the lock file
+	pid  int         // pid is the simulated process, 0 for an open file
+	held rangeSet
+}
+
+// NewFakeBackend returns a FakeBackend on which nothing is held.
+func NewFakeBackend() *FakeBackend {
+	b := &FakeBackend{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Hold makes the simulated process identified by h.PID hold length bytes from
+// offset of the lock on path in h.Mode, creating the lock file if needed. A length
+// of zero holds every byte from offset on; holding the whole file also writes h as
+// the holder record, as a FileLock would. Hold fails with ErrWouldBlock if the lock
+// is held by others.
+func (b *FakeBackend) Hold(path string, h Holder, offset, length int64) error {
+	if !filepath.IsAbs(path) {
+		return ErrNotAbsolutePath
+	}
+	if h.Mode != Shared && h.Mode != Exclusive {
+		return ErrInvalidMode
+	}
+
+	file, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o := b.process(fi, h.PID)
+	lock := Flock{Mode: h.Mode, Start: offset, Len: length}
+	if _, ok := b.conflict(o, &lock); ok {
+		return ErrWouldBlock
+	}
+	o.held = o.held.set(fakeSpan(&lock))
+
+	if offset == 0 && length == 0 {
+		return writeHolder(file, &h)
+	}
+	return nil
+}
+
+// Release drops the locks the simulated process pid holds on path, waking the
+// FileLock values waiting for them.
+func (b *FakeBackend) Release(path string, pid int) error {
+	fi, err := os.Stat(path + ".lock")
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.owners = slices.DeleteFunc(b.owners, func(o *fakeOwner) bool {
+		return o.file == nil && o.pid == pid && os.SameFile(o.fi, fi)
+	})
+	b.cond.Broadcast()
+	return nil
+}
+
+// Fail makes every later lock request fail with err, as a broken file system
+// would, until Fail is called with nil. Releases keep working.
+func (b *FakeBackend) Fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fail = err
+}
+
+func (b *FakeBackend) SetLock(file *os.File, lock *Flock, wait bool) error {
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.fail != nil && lock.Mode != Unlocked {
+		return b.fail
+	}
+	o := b.open(file, fi)
+	for {
+		if _, ok := b.conflict(o, lock); !ok || lock.Mode == Unlocked {
+			break
+		}
+		if !wait {
+			return ErrWouldBlock
+		}
+		b.cond.Wait()
+	}
+
+	o.held = o.held.set(fakeSpan(lock))
+	b.cond.Broadcast()
+	return nil
+}
+
+func (b *FakeBackend) GetLock(file *os.File, lock *Flock) error {
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	conflict, ok := b.conflict(b.open(file, fi), lock)
+	if !ok {
+		lock.Mode = Unlocked
+		return nil
+	}
+	*lock = conflict
+	return nil
+}
+
+func (b *FakeBackend) Ranges() bool        { return true }
+func (b *FakeBackend) Interruptible() bool { return false }
+
+// open returns the owner of the locks held through file, dropping those of the
+// files closed since. The caller must hold b.mu.
+func (b *FakeBackend) open(file *os.File, fi os.FileInfo) *fakeOwner {
+	// Closing a file drops its locks.
+	b.owners = slices.DeleteFunc(b.owners, func(o *fakeOwner) bool {
+		if o.file == nil || o.file == file {
+			return false
+		}
+		_, err := o.file.Stat()
+		return err != nil
+	})
+
+	for _, o := range b.owners {
+		if o.file == file {
+			return o
+		}
+	}
+	o := &fakeOwner{file: file, fi: fi}
+	b.owners = append(b.owners, o)
+	return o
+}
+
+// process returns the owner of the locks held by the simulated process pid on the
+// lock file fi. The caller must hold b.mu.
+func (b *FakeBackend) process(fi os.FileInfo, pid int) *fakeOwner {
+	for _, o := range b.owners {
+		if o.file == nil && o.pid == pid && os.SameFile(o.fi, fi) {
+			return o
+		}
+	}
+	o := &fakeOwner{fi: fi, pid: pid}
+	b.owners = append(b.owners, o)
+	return o
+}
+
+// conflict returns the first lock held by another owner of the same lock file
+// that conflicts with lock. The caller must hold b.mu.
+func (b *FakeBackend) conflict(owner *fakeOwner, lock *Flock) (Flock, bool) {
+	want := fakeSpan(lock)
+	for _, o := range b.owners {
+		if o == owner || !os.SameFile(o.fi, owner.fi) {
+			continue
+		}
+		for _, s := range o.held {
+			if s.start < want.end && want.start < s.end && (s.mode == Exclusive || want.mode == Exclusive) {
+				return Flock{Mode: s.mode, Start: s.start, Len: s.end - s.start, Pid: o.pid}, true
+			}
+		}
+	}
+	return Flock{}, false
+}
+
+// fakeSpan returns the bytes covered by lock, where a length of zero covers every
+// byte from its start on.
+func fakeSpan(lock *Flock) span {
+	end := int64(math.MaxInt64)
+	if lock.Len != 0 {
+		end = lock.Start + lock.Len
+	}
+	return span{start: lock.Start, end: end, mode: lock.Mode}
+}
@@ -0,0 +1,106 @@
+package filelock
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeBackend(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+	fake := NewFakeBackend()
+
+	_, err := New(file, WithBackend(nil))
+	require.ErrorIs(t, err, ErrUnsupported)
+
+	a, err := New(file, WithBackend(fake))
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := New(file, WithBackend(fake))
+	require.NoError(t, err)
+	defer b.Close()
+
+	// A writer excludes the other FileLock, polling or waiting, and is named on
+	// timeout.
+	require.NoError(t, a.WLock(WithLabel("writer")))
+	err = b.RLock(WithTimeout(100 * time.Millisecond))
+	require.ErrorIs(t, err, ErrTimeout)
+	require.ErrorIs(t, err, ErrWouldBlock)
+	var lockErr *LockError
+	require.ErrorAs(t, err, &lockErr)
+	require.NotNil(t, lockErr.Holder)
+	require.Equal(t, "writer", lockErr.Holder.Label)
+	require.ErrorIs(t, b.WLock(WithBlock(), WithTimeout(100*time.Millisecond)), ErrTimeout)
+
+	// Readers share the lock, and a shared holder cannot upgrade while another
+	// one remains.
+	require.NoError(t, a.Downgrade())
+	require.NoError(t, b.RLock())
+	state, err := a.TryInspect()
+	require.NoError(t, err)
+	require.Equal(t, Shared, state.Mode)
+	require.ErrorIs(t, a.Upgrade(WithTimeout(100*time.Millisecond)), ErrTimeout)
+	require.NoError(t, b.Unlock())
+	require.NoError(t, a.Upgrade())
+	require.NoError(t, a.Unlock())
+
+	// Byte ranges only conflict where they overlap.
+	require.NoError(t, a.WLockRange(0, 10))
+	require.NoError(t, b.WLockRange(10, 10))
+	require.ErrorIs(t, b.RLockRange(5, 1, WithTimeout(100*time.Millisecond)), ErrTimeout)
+	require.Equal(t, []Range{{Offset: 10, Length: 10, Mode: Exclusive}}, b.Ranges())
+}
+
+func TestFakeBackend_virtualTime(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	fake := NewFakeBackend()
+
+	l, err := New(file, WithBackend(fake), WithClock(clock))
+	require.NoError(t, err)
+	defer l.Close()
+
+	// Another process holds the lock past the timeout of the waiter.
+	require.NoError(t, fake.Hold(file, Holder{PID: 42, Mode: Exclusive, Label: "batch"}, 0, 0))
+	errC := make(chan error, 1)
+	go func() { errC <- l.WLock(WithTimeout(time.Minute)) }()
+	clock.BlockUntil(2) // the timeout and the first backoff delay
+	clock.Advance(time.Minute)
+
+	err = <-errC
+	require.ErrorIs(t, err, ErrTimeout)
+	var lockErr *LockError
+	require.ErrorAs(t, err, &lockErr)
+	require.Equal(t, 42, lockErr.Holder.PID)
+	require.Equal(t, "batch", lockErr.Holder.Label)
+
+	// The waiter gets the lock at its next attempt once the holder releases it.
+	go func() { errC <- l.WLock(WithBlock(), WithTimeout(time.Minute)) }()
+	clock.BlockUntil(2)
+	require.NoError(t, fake.Release(file, 42))
+	clock.Advance(maxWaitDuration)
+	require.NoError(t, <-errC)
+
+	h, err := l.Holder()
+	require.NoError(t, err)
+	require.True(t, h.Acquired.Equal(start.Add(time.Minute+maxWaitDuration)), h.Acquired)
+	require.NoError(t, l.Unlock())
+
+	// Lock requests fail at once while the backend is broken, rather than being
+	// retried until the timeout like contended ones.
+	errIO := errors.New("input/output error")
+	fake.Fail(errIO)
+	err = l.RLock(WithTimeout(time.Hour))
+	require.ErrorIs(t, err, errIO)
+	require.NotErrorIs(t, err, ErrTimeout)
+	require.ErrorAs(t, err, &lockErr)
+	require.Equal(t, "RLock", lockErr.Op)
+	require.Equal(t, 1, l.Stats().LastAttempts)
+	fake.Fail(nil)
+	require.NoError(t, l.RLock())
+	require.NoError(t, l.Unlock())
+}
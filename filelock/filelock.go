@@ -1,33 +1,28 @@
-//go:build dragonfly || freebsd || linux || netbsd
-
 package filelock
 
 import (
 	"context"
 	"errors"
 	"fmt"
-	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"golang.org/x/sys/unix"
 )
 
 var (
-	randomGenerator = rand.New(rand.NewSource(time.Now().UnixNano()))
-
 	ErrTimeout         = errors.New("acquiring lock timeout")
 	ErrNotAbsolutePath = errors.New("lock path is not absolute")
+	ErrUnsupported     = errors.New("lock backend not supported on this platform")
+	ErrNotHeld         = errors.New("lock is not held in the required mode")
+	ErrClosed          = errors.New("file lock is closed")
+	ErrUpgradeConflict = errors.New("another holder is upgrading the shared lock")
+	ErrDeadlock        = errors.New("lock deadlock")
 )
 
-const (
-	defaultLockTimeout = 30 * time.Second
-
-	minWaitDuration = 200 * time.Millisecond
-	maxWaitDuration = 600 * time.Millisecond
-)
+const defaultLockTimeout = 30 * time.Second
 
 type config struct {
 	// ctx is the context for the lock operation.
@@ -40,11 +35,77 @@ type config struct {
 	// block is a flag that indicates whether to block until the lock is acquired.
 	block bool
 
+	// kernel is a flag that indicates whether blocking waits in the kernel instead
+	// of polling.
+	kernel bool
+
 	// remove is a flag that indicates whether to remove the lock file when the lock is released.
 	remove bool
+
+	// backoff decides how long to wait between attempts to acquire the lock.
+	// Defaults to a random delay between minWaitDuration and maxWaitDuration.
+	backoff Backoff
+
+	// label is an optional caller-supplied description recorded with the holder.
+	label string
+
+	// lease is the time to live of a lease on the whole file, zero for no lease.
+	lease time.Duration
+
+	// fair is a flag that indicates whether waiters queue up in arrival order.
+	fair bool
+
+	// observer receives the events of the lock operation, if not nil.
+	observer Observer
+
+	// clock tells the time for the timeouts and backoff of the lock operation.
+	// Defaults to the system clock.
+	clock Clock
+
+	// rand jitters the delays of the built-in backoff policies. Defaults to the
+	// global source of math/rand/v2.
+	rand Rand
+
+	// graph is the wait-for graph used to detect deadlocks, nil for none.
+	graph *waitGraph
+
+	// cacheSize is the number of idle lock files a Manager keeps open.
+	// Defaults to defaultCacheSize. It is only consulted by NewManager.
+	cacheSize int
+
+	// backend is the locking mechanism, nil if the requested one is unsupported.
+	// Defaults to classic POSIX record locks. It is only consulted by New.
+	backend Backend
+}
+
+// newConfig returns the default configuration overridden by opts.
+func newConfig(opts []Option) *config {
+	c := &config{
+		ctx:       context.Background(),
+		timeout:   defaultLockTimeout,
+		block:     false,
+		remove:    false,
+		backoff:   defaultBackoff,
+		clock:     systemClock{},
+		rand:      systemRand{},
+		cacheSize: defaultCacheSize,
+		backend:   posixBackend,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// since returns the time passed since t, as told by the clock of c.
+func (c *config) since(t time.Time) time.Duration {
+	return c.clock.Now().Sub(t)
 }
 
 // Option is a function type that can be used to customize the behavior of a FileLock.
+//
+// Options passed to New set the defaults of the FileLock. Options passed to a lock
+// call override those defaults for that call only and never leak into later calls.
 type Option func(*config)
 
 // WithContext returns an Option that sets the context for the lock operation.
@@ -63,22 +124,110 @@ func WithTimeout(timeout time.Duration) Option {
 // WithBlock returns an Option that sets the lock to block until acquired.
 // This option configures the FileLock to wait indefinitely until the lock can
 // be acquired, rather than returning immediately if the lock is not available.
+//
+// The lock is polled at a short interval, so it is acquired shortly after it is
+// released, and the wait ends with the timeout or the context. Use WithKernelWait
+// to wait in the kernel instead.
 func WithBlock() Option {
 	return func(c *config) { c.block = true }
 }
 
+// WithKernelWait returns an Option that sets the lock to block until acquired, as
+// WithBlock does, but waiting in the kernel with F_SETLKW or flock instead of
+// polling, so the lock is acquired as soon as it is released.
+//
+// On Linux, a wait that times out or is canceled is interrupted with realtime
+// signal 63 sent to the waiting thread. The first such wait clears SA_RESTART from
+// the handler the Go runtime installed for the signal, and a program that calls
+// signal.Notify without naming signals receives it every time a wait is
+// interrupted. Concurrent calls of signal.Notify or signal.Reset may restore
+// SA_RESTART, which the interrupt clears again, so the wait may overrun its
+// timeout by a few milliseconds. On the platforms where a wait in the kernel
+// cannot be interrupted, the lock is polled as with WithBlock.
+func WithKernelWait() Option {
+	return func(c *config) { c.block, c.kernel = true, true }
+}
+
 // WithRemove returns an Option that sets the lock to be removed when released.
 // This option configures the FileLock to automatically remove the lock file
 // when the lock is released, cleaning up any temporary files created during
 // the locking process.
+//
+// The lock file is only removed while the FileLock holds it exclusively, so it is
+// left in place when other processes share it. A process that opened the lock file
+// before it was removed notices, once it acquires the lock, that the file is no
+// longer the one at the lock path, and retries with a new one.
 func WithRemove() Option {
 	return func(c *config) { c.remove = true }
 }
 
+// WithBackoff returns an Option that sets the strategy deciding how long to wait
+// between attempts to acquire a lock that is not available. It has no effect
+// on locks acquired with WithBlock or WithKernelWait, which poll at a short
+// interval or wait in the kernel instead.
+func WithBackoff(b Backoff) Option {
+	return func(c *config) { c.backoff = b }
+}
+
+// WithLabel returns an Option that records label in the holder information written
+// to the lock file, to tell holders apart when inspecting a contended lock.
+func WithLabel(label string) Option {
+	return func(c *config) { c.label = label }
+}
+
+// WithObserver returns an Option that reports the attempts, contention, outcome
+// and release of lock acquisitions to o.
+func WithObserver(o Observer) Option {
+	return func(c *config) { c.observer = o }
+}
+
+// WithOFD returns an Option that makes the FileLock use open file description
+// locks (F_OFD_SETLK and F_OFD_SETLKW) instead of classic POSIX record locks.
+//
+// OFD locks belong to the open file description rather than to the process, so
+// separate FileLock values exclude each other even within a single process, and
+// closing an unrelated descriptor of the same file does not drop them. OFD locks
+// are only available on Linux; elsewhere New fails with ErrUnsupported.
+//
+// The backend is fixed for the lifetime of the FileLock, so WithOFD only takes
+// effect when passed to New.
+func WithOFD() Option {
+	return func(c *config) { c.backend = ofdBackend }
+}
+
+// WithFlock returns an Option that makes the FileLock use flock(2) instead of
+// fcntl record locks.
+//
+// flock locks belong to the open file description, survive fork and exec of
+// child processes that inherit the descriptor, and interoperate with the flock(1)
+// utility. They always cover the whole file, so the range methods fail with
+// ErrRangeUnsupported.
+//
+// The backend is fixed for the lifetime of the FileLock, so WithFlock only takes
+// effect when passed to New.
+func WithFlock() Option {
+	return func(c *config) { c.backend = flockBackend }
+}
+
+// FileLock is a lock on a target path, implemented with a lock file next to it.
+//
+// A FileLock can be locked and unlocked any number of times: Unlock closes the lock
+// file and the next acquisition reopens it. Close retires the FileLock for good.
+//
+// Except with WithOFD, separate FileLock values for the same path in one process
+// do not exclude each other. RWLock coordinates the goroutines of the process too.
 type FileLock struct {
 	config *config    // config is the configuration for the lock operation
 	path   string     // path is the target path which the FileLock protects
-	file   *os.File   // file is the underlying file descriptor used for locking
+	file   *os.File   // file is the underlying file descriptor used for locking, nil while released
+	lk     Backend    // lk is the locking mechanism applied to file
+	ranges rangeSet   // ranges mirrors the byte ranges held on file
+	stats  Stats      // stats counts the acquisitions made by the FileLock
+	acq    *config    // acq is the configuration of the call that acquired the held lock
+	lease  *lease     // lease is the heartbeat of the held lease, nil if none
+	since  time.Time  // since is when the FileLock last went from holding nothing to holding a lock
+	graph  *waitGraph // graph is the wait-for graph recording the held locks, nil if none
+	closed bool       // closed is set once Close has been called
 	mu     sync.Mutex // guard against FileLock
 }
 
@@ -86,181 +235,787 @@ type FileLock struct {
 //
 // It takes a path to the file that needs to be locked and creates a lock file
 // with the same name plus a ".lock" extension in the same directory.
-func New(path string) (*FileLock, error) {
+//
+// New optionally accepts a variable number of Option functions that set the defaults
+// for every lock operation on the returned FileLock.
+//
+// Locks are implemented on Darwin, Linux and the BSDs. Elsewhere, and with a
+// backend the platform lacks, New fails with ErrUnsupported.
+func New(path string, opts ...Option) (*FileLock, error) {
 	if !filepath.IsAbs(path) {
 		return nil, ErrNotAbsolutePath
 	}
 
-	dir := filepath.Dir(path)
-	name := filepath.Base(path)
+	c := newConfig(opts)
+	if c.backend == nil {
+		return nil, ErrUnsupported
+	}
 
-	file, err := os.OpenFile(filepath.Join(dir, name+".lock"), os.O_CREATE|os.O_RDWR, 0o600)
-	if err != nil {
+	l := &FileLock{
+		config: c,
+		path:   path,
+		lk:     c.backend,
+	}
+	if err := l.open(); err != nil {
 		return nil, err
 	}
 
-	return &FileLock{
-		config: &config{
-			ctx:     context.Background(),
-			timeout: defaultLockTimeout,
-			block:   false,
-			remove:  false,
-		},
-		path: path,
-		file: file,
-	}, nil
+	return l, nil
 }
 
 // RLock acquires a shared lock on behalf of the current process on the file represented
 // by the FileLock. If there is another process already held an exclusive lock on the file,
 // RLock blocks until the lock is available.
 //
+// If the WithKernelWait option is provided, RLock waits for the lock in the kernel with
+// the F_SETLKW operation, the same way WLock does, and acquires it as soon as the writer
+// releases it instead of polling.
+//
 // RLock optionally accepts a variable number of Option functions to customize the lock behavior.
 func (l *FileLock) RLock(opts ...Option) error {
-	for _, opt := range opts {
-		opt(l.config)
-	}
-
-	// Create a Flock_t structure.
-	lock := unix.Flock_t{
-		Type:   unix.F_RDLCK, // read lock, shared lock
-		Whence: 0,            // relative to the start of the file
-		Start:  0,            // lock starts at byte 0
-		Len:    0,            // lock extends to EOF
-	}
+	return lockError("RLock", l.path, Shared, l.lockRange(Shared, 0, 0, opts))
+}
 
-	return l.acquireLock(lock)
+// RLockRange acquires a shared lock on length bytes of the target starting at offset.
+// A length of zero locks from offset to the end of the file, however large it grows.
+//
+// Ranges are tracked per FileLock the same way the kernel tracks them: locking a range
+// that overlaps one already held replaces the overlapped part, so a range can be
+// downgraded from exclusive to shared in place. RLockRange accepts the same options
+// as RLock, including WithBlock.
+func (l *FileLock) RLockRange(offset, length int64, opts ...Option) error {
+	return lockError("RLockRange", l.path, Shared, l.lockRange(Shared, offset, length, opts))
 }
 
 // WLock acquires an exclusive lock on behalf of the current process on the file represented
 // by the FileLock. If there is another process already holding a lock on the file,
 // WLock blocks until the lock is available.
 //
-// If the WithBlock option is provided, WLock will use the fcntl F_SETLK syscall with the
+// If the WithKernelWait option is provided, WLock will use the fcntl syscall with the
 // F_SETLKW operation, indicating that WLock wants to wait until the lock can be acquired,
 // rather than returning immediately if the lock is not available.
 //
 // WLock optionally accepts a variable number of Option functions to customize the lock behavior.
 func (l *FileLock) WLock(opts ...Option) error {
-	for _, opt := range opts {
-		opt(l.config)
+	return lockError("WLock", l.path, Exclusive, l.lockRange(Exclusive, 0, 0, opts))
+}
+
+// WLockRange acquires an exclusive lock on length bytes of the target starting at offset.
+// A length of zero locks from offset to the end of the file, however large it grows.
+//
+// Processes locking disjoint ranges do not exclude each other. WLockRange accepts the
+// same options as WLock, including WithBlock.
+func (l *FileLock) WLockRange(offset, length int64, opts ...Option) error {
+	return lockError("WLockRange", l.path, Exclusive, l.lockRange(Exclusive, offset, length, opts))
+}
+
+// Upgrade atomically converts the shared lock held on the whole file into an
+// exclusive lock, without releasing it in between. It waits for the other shared
+// holders to release their locks and accepts the same options as WLock.
+//
+// If another holder is already upgrading, the two would wait on each other forever,
+// so Upgrade fails immediately with ErrUpgradeConflict and the shared lock is kept.
+// The caller should usually release it to let the other holder proceed. On timeout
+// or cancellation the shared lock is kept as well.
+//
+// With the flock backend the conversion is not atomic: the kernel may drop the
+// shared lock before granting the exclusive one, and if Upgrade fails the shared
+// lock is lost when another process takes the file in the meantime, in which case
+// Ranges no longer reports it.
+//
+// Upgrade returns ErrNotHeld unless the FileLock holds the whole file in shared mode,
+// and does nothing if the lock is already exclusive.
+func (l *FileLock) Upgrade(opts ...Option) error {
+	return lockError("Upgrade", l.path, Exclusive, l.upgrade(opts))
+}
+
+func (l *FileLock) upgrade(opts []Option) error {
+	c := l.options(opts)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	if l.holds(Exclusive) {
+		return nil
 	}
+	if !l.holds(Shared) {
+		return ErrNotHeld
+	}
+
+	if l.lk.Ranges() {
+		// Announce the upgrade on a reserved byte. Only one holder can do so at a
+		// time, so a second upgrader detects that it would deadlock.
+		intent := newFlock(Exclusive, upgradeOffset, 1)
+		if err := l.lk.SetLock(l.file, &intent, false); err != nil {
+			if contended(err) {
+				return fmt.Errorf("%w: %w", ErrUpgradeConflict, err)
+			}
+			return fmt.Errorf("announcing upgrade: %w", err)
+		}
+		defer func() {
+			intent.Mode = Unlocked
+			_ = l.lk.SetLock(l.file, &intent, false)
+		}()
+	}
+
+	lock := newFlock(Exclusive, 0, 0)
+	err := l.acquire(c, lock)
+	if err != nil && !l.lk.Ranges() {
+		// flock, the only backend without ranges, drops the shared lock when a
+		// conversion fails, so take it back if nobody else grabbed the file.
+		l.reapply(lock)
+	}
+
+	return err
+}
+
+// Downgrade atomically converts the exclusive lock held on the whole file into a
+// shared lock, letting other readers in without ever leaving the file unlocked.
+//
+// Downgrade returns ErrNotHeld unless the FileLock holds the whole file in exclusive
+// mode, and does nothing if the lock is already shared.
+func (l *FileLock) Downgrade() error {
+	return lockError("Downgrade", l.path, Shared, l.downgrade())
+}
 
-	if l.config.block {
-		return l.acquireLockWait()
+func (l *FileLock) downgrade() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	if l.holds(Shared) {
+		return nil
+	}
+	if !l.holds(Exclusive) {
+		return ErrNotHeld
 	}
 
-	// Create a Flock_t structure.
-	lock := unix.Flock_t{
-		Type:   unix.F_WRLCK, // write lock, exclusive lock
-		Whence: 0,            // relative to the start of the file
-		Start:  0,            // lock starts at byte 0
-		Len:    0,            // lock extends to EOF
+	lock := newFlock(Shared, 0, 0)
+	if err := l.lk.SetLock(l.file, &lock, false); err != nil {
+		return fmt.Errorf("downgrading lock: %w", err)
 	}
 
-	return l.acquireLock(lock)
+	l.acquired(l.acq, lock)
+	return nil
 }
 
 // Unlock releases the lock held by the FileLock.
 //
 // Unlock first releases the lock on the underlying file using the fcntl F_SETLK
 // syscall with the F_UNLCK operation. After releasing the lock, it closes the
-// file descriptor associated with the lock file.
+// file descriptor associated with the lock file. The FileLock remains usable and
+// reopens the lock file on the next acquisition. Unlocking a FileLock that is
+// already released does nothing.
 func (l *FileLock) Unlock() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	// Create a Flock_t structure.
-	lock := unix.Flock_t{
-		Type:   unix.F_UNLCK, // unlock
-		Whence: 0,            // relative to the start of the file
-		Start:  0,            // lock starts at byte 0
-		Len:    0,            // lock extends to EOF
+	if l.closed {
+		return lockError("Unlock", l.path, Unlocked, ErrClosed)
+	}
+	if l.file == nil {
+		return nil
 	}
 
-	// Apply the lock using fcntl.
-	if err := unix.FcntlFlock(l.file.Fd(), unix.F_SETLK, &lock); err != nil {
-		return fmt.Errorf("releasing lock: %w", err)
+	return lockError("Unlock", l.path, Unlocked, l.releaseFile())
+}
+
+// Close releases the lock held by the FileLock, if any, and retires it.
+// Every later call on the FileLock fails with ErrClosed.
+func (l *FileLock) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return lockError("Close", l.path, Unlocked, ErrClosed)
+	}
+	l.closed = true
+	if l.file == nil {
+		return nil
 	}
 
-	err := l.file.Close()
-	if l.config.remove {
-		removeErr := os.Remove(l.path + ".lock")
-		return errors.Join(err, removeErr)
+	return lockError("Close", l.path, Unlocked, l.releaseFile())
+}
+
+// UnlockRange releases length bytes of the lock starting at offset. Unlike Unlock,
+// it keeps the lock file open so that the FileLock can go on locking other ranges.
+func (l *FileLock) UnlockRange(offset, length int64) error {
+	return lockError("UnlockRange", l.path, Unlocked, l.unlockRange(offset, length))
+}
+
+func (l *FileLock) unlockRange(offset, length int64) error {
+	if err := l.validateRange(offset, length); err != nil {
+		return err
 	}
 
-	return err
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	if l.file == nil {
+		return nil
+	}
+
+	return l.release(offset, length)
+}
+
+// Stats returns the acquisition counters of the FileLock.
+func (l *FileLock) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.stats
 }
 
-func (l *FileLock) acquireLock(lock unix.Flock_t) error {
+// Ranges returns the byte ranges currently held by the FileLock, sorted by offset.
+func (l *FileLock) Ranges() []Range {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.ranges.ranges()
+}
+
+// lockRange locks length bytes from offset in mode.
+func (l *FileLock) lockRange(mode Mode, offset, length int64, opts []Option) error {
+	if err := l.validateRange(offset, length); err != nil {
+		return err
+	}
+
+	c := l.options(opts)
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	// Start a goroutine to enforce the timeout.
-	timeoutC := time.After(l.config.timeout)
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	return l.acquire(c, newFlock(mode, offset, length))
+}
+
+// options returns the configuration of a single call: the defaults set by New,
+// overridden by opts. The defaults themselves are left untouched.
+func (l *FileLock) options(opts []Option) *config {
+	c := *l.config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return &c
+}
+
+// validateRange reports whether the range can be locked with the backend of l.
+func (l *FileLock) validateRange(offset, length int64) error {
+	if err := validateRange(offset, length); err != nil {
+		return err
+	}
+	if !l.lk.Ranges() && (offset != 0 || length != 0) {
+		return ErrRangeUnsupported
+	}
+	return nil
+}
+
+// open opens the lock file unless it is already open.
+// The caller must hold l.mu.
+func (l *FileLock) open() error {
+	if l.closed {
+		return ErrClosed
+	}
+	if l.file != nil {
+		return nil
+	}
+
+	file, err := openLockFile(l.path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+
+	l.file = file
+	return nil
+}
+
+// releaseFile releases every lock held on the lock file and closes it.
+// The caller must hold l.mu.
+func (l *FileLock) releaseFile() error {
+	l.dropLease()
+
+	remove := l.config.remove || (l.acq != nil && l.acq.remove)
+	if remove && !l.holds(Exclusive) {
+		// Only remove the lock file if nobody else holds it.
+		lock := newFlock(Exclusive, 0, 0)
+		remove = l.lk.SetLock(l.file, &lock, false) == nil
+		if remove {
+			l.ranges = l.ranges.set(newSpan(0, 0, Exclusive))
+		}
+	}
+
+	var removeErr error
+	if l.holds(Exclusive) {
+		// Nobody else holds the lock, so the holder information is ours to clear.
+		_ = l.file.Truncate(0)
+		if ok, _ := l.current(); remove && ok {
+			// Remove the lock file while still holding it, so that whoever opened
+			// it in the meantime finds out once they get the lock. A lock file that
+			// is no longer at the lock path, because a waiter broke the lease on
+			// it, is left alone so as not to remove the one that replaced it.
+			removeErr = os.Remove(l.path + ".lock")
+		}
+	}
+	if err := l.release(0, 0); err != nil {
+		return errors.Join(err, removeErr)
+	}
+	l.acq = nil
+
+	err := closeLockFile(l.file)
+	l.file = nil
+
+	return errors.Join(err, removeErr)
+}
+
+// current reports whether the open lock file is still the one at the lock path,
+// rather than one removed by its previous holder.
+// The caller must hold l.mu.
+func (l *FileLock) current() (bool, error) {
+	return sameFile(l.file, l.path+".lock")
+}
+
+// sameFile reports whether file is the file at name.
+func sameFile(file *os.File, name string) (bool, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	pi, err := os.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(fi, pi), nil
+}
+
+// holds reports whether the whole file is held in mode m.
+// The caller must hold l.mu.
+func (l *FileLock) holds(m Mode) bool {
+	return len(l.ranges) == 1 && l.ranges[0] == newSpan(0, 0, m)
+}
+
+// release unlocks the given range and drops it from the bookkeeping.
+// The caller must hold l.mu.
+func (l *FileLock) release(offset, length int64) error {
+	lock := newFlock(Unlocked, offset, length)
+	if err := l.lk.SetLock(l.file, &lock, false); err != nil {
+		return fmt.Errorf("releasing lock: %w", err)
+	}
+
+	s := newSpan(offset, length, Unlocked)
+	released := Unlocked
+	for _, e := range l.ranges {
+		if e.end > s.start && e.start < s.end {
+			released = max(released, e.mode)
+		}
+	}
+
+	l.ranges = l.ranges.set(s)
+	l.syncGraph()
+	if len(l.ranges) == 0 && released != Unlocked {
+		l.stopLease()
+
+		c := l.acq
+		if c == nil {
+			c = l.config
+		}
+		l.observe(c, Observer.Released, Event{Mode: released, Wait: c.since(l.since)})
+	}
+	return nil
+}
+
+// observe reports e, an event of a call configured with c, to its observer if any.
+func (l *FileLock) observe(c *config, report func(Observer, Event), e Event) {
+	if c.observer == nil {
+		return
+	}
+	e.Path = l.path
+	report(c.observer, e)
+}
+
+// acquired records a lock successfully applied by a call configured with c in the
+// bookkeeping and, for a lock on the whole file, the holder information in the lock
+// file. The caller must hold l.mu.
+func (l *FileLock) acquired(c *config, lock Flock) {
+	if len(l.ranges) == 0 {
+		l.since = c.clock.Now()
+	}
+	l.ranges = l.ranges.set(newSpan(lock.Start, lock.Len, lock.Mode))
+	l.acq = c
+	if l.graph == nil {
+		l.graph = c.graph
+	}
+	l.syncGraph()
+
+	if lock.Start == 0 && lock.Len == maxOffset {
+		h := newHolder(lock.Mode, c.label, c.clock.Now())
+		if c.lease > 0 {
+			h.Heartbeat = h.Acquired
+		}
+		// The holder information is informational only, so failing to record it
+		// does not fail the acquisition.
+		_ = writeHolder(l.file, h)
+		l.startLease(c, h)
+	}
+}
+
+// reapply resets the bytes of lock to the modes recorded in the bookkeeping,
+// undoing a lock the kernel granted after the caller stopped waiting for it
+// without dropping what the caller held before. Bytes that can no longer be
+// held in their recorded mode are dropped from the bookkeeping.
+// The caller must hold l.mu.
+func (l *FileLock) reapply(lock Flock) {
+	s := newSpan(lock.Start, lock.Len, Unlocked)
+	next := s.start
+	var lost []span
+	for _, e := range l.ranges {
+		if e.end <= s.start || e.start >= s.end {
+			continue
+		}
+		start, end := max(e.start, s.start), min(e.end, s.end)
+		if next < start {
+			unlock := newFlock(Unlocked, next, start-next)
+			_ = l.lk.SetLock(l.file, &unlock, false)
+		}
+		held := newFlock(e.mode, start, end-start)
+		if err := l.lk.SetLock(l.file, &held, false); err != nil {
+			lost = append(lost, span{start: start, end: end, mode: Unlocked})
+		}
+		next = end
+	}
+	if next < s.end {
+		unlock := newFlock(Unlocked, next, s.end-next)
+		_ = l.lk.SetLock(l.file, &unlock, false)
+	}
+
+	for _, e := range lost {
+		l.ranges = l.ranges.set(e)
+	}
+	l.syncGraph()
+}
+
+// acquire acquires lock, polling or waiting in the kernel as configured by c.
+// The caller must hold l.mu.
+//
+// When the FileLock held nothing before, acquire also checks that the lock file it
+// locked is still the one at the lock path. If the previous holder removed it in the
+// meantime, the lock protects nothing, so acquire reopens the lock file and tries
+// again within the same timeout. The same goes for a lock file removed while
+// waiting, because the lease on it was broken.
+//
+// A fair call holding nothing waits for its turn in the queue first.
+func (l *FileLock) acquire(c *config, lock Flock) error {
+	start := c.clock.Now()
+	deadline := start.Add(c.timeout)
+	if c.fair && len(l.ranges) == 0 {
+		t, err := enqueue(l.path)
+		if err != nil {
+			return err
+		}
+		defer t.leave()
+
+		if err := t.wait(c, deadline); err != nil {
+			l.stats.record(1, false)
+			if errors.Is(err, ErrTimeout) {
+				err = l.timeoutError(lock, nil)
+			}
+			l.failed(c, lock, start, 0, err)
+			return err
+		}
+
+		queued := *c
+		queued.timeout = deadline.Sub(c.clock.Now())
+		c = &queued
+	}
 
 	for {
+		fresh := len(l.ranges) == 0
+
+		var err error
+		if c.block {
+			err = l.acquireLockWait(c, lock, start)
+		} else {
+			err = l.acquireLock(c, lock, start)
+		}
+		if !errors.Is(err, errLeaseBroken) {
+			if err != nil || !fresh {
+				return err
+			}
+
+			ok, err := l.current()
+			if ok || err != nil {
+				return err
+			}
+		}
+
+		// Closing the stale lock file releases the lock on it.
+		_ = closeLockFile(l.file)
+		l.file = nil
+		l.ranges = nil
+		l.acq = nil
+		l.syncGraph()
+		if err := l.open(); err != nil {
+			return err
+		}
+
+		retry := *c
+		retry.timeout = deadline.Sub(c.clock.Now())
+		c = &retry
+	}
+}
+
+// acquireLock polls for lock until it is granted or the timeout or context expire,
+// or the backend fails with an error other than contention. The acquisition started
+// at start. The caller must hold l.mu.
+func (l *FileLock) acquireLock(c *config, lock Flock, start time.Time) error {
+	if err := c.ctx.Err(); err != nil {
+		l.failed(c, lock, start, 0, err)
+		return err
+	}
+
+	// The timeout covers every attempt, along with the delays between them.
+	timeoutC := c.clock.After(c.timeout)
+
+	wc := l.newWaitCheck(c, lock)
+	defer wc.done()
+
+	mode := lock.Mode
+	var delay time.Duration
+	for attempt := 1; ; attempt++ {
+		// Acquire the lock.
+		l.observe(c, Observer.Attempt, Event{Mode: mode, Attempts: attempt, Wait: c.since(start)})
+		err := l.lk.SetLock(l.file, &lock, false)
+		if err == nil {
+			l.acquired(c, lock)
+			l.stats.record(attempt, true)
+			l.observe(c, Observer.Acquired, Event{Mode: mode, Attempts: attempt, Wait: c.since(start)})
+			return nil
+		}
+		if !contended(err) {
+			// Only contention passes with time; other errors are returned at once.
+			l.stats.record(attempt, false)
+			l.failed(c, lock, start, attempt, err)
+			return err
+		}
+		l.observe(c, Observer.Contention, Event{Mode: mode, Attempts: attempt, Wait: c.since(start)})
+		if err := wc.check(); err != nil {
+			l.stats.record(attempt, false)
+			return err
+		}
+
+		if l.breakable(c, lock) && l.breakLease(c, lock) {
+			return errLeaseBroken
+		}
+
+		// Wait for a while for the next retry.
+		delay = c.nextDelay(c.backoff, attempt, delay)
 		select {
 		case <-timeoutC:
-			return ErrTimeout
-		case <-l.config.ctx.Done():
-			return fmt.Errorf("acquiring lock context canceled: %w", l.config.ctx.Err())
-		default:
-			// Acquire the lock.
-			err := unix.FcntlFlock(l.file.Fd(), unix.F_SETLK, &lock)
-			if err == nil {
-				return nil
-			}
-			// Sleep for a while for the next retry.
-			time.Sleep(randomDuration(minWaitDuration, maxWaitDuration))
+			l.stats.record(attempt, false)
+			err := l.timeoutError(lock, err)
+			l.failed(c, lock, start, attempt, err)
+			return err
+		case <-c.ctx.Done():
+			l.stats.record(attempt, false)
+			err := c.ctx.Err()
+			l.failed(c, lock, start, attempt, err)
+			return err
+		case <-c.clock.After(delay):
 		}
 	}
 }
 
-func (l *FileLock) acquireLockWait() error {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+// failed reports to the observer of c that the acquisition of lock started at start
+// gave up with err after the given number of attempts.
+func (l *FileLock) failed(c *config, lock Flock, start time.Time, attempts int, err error) {
+	e := Event{Mode: lock.Mode, Attempts: attempts, Wait: c.since(start), Err: err}
+	if errors.Is(err, ErrTimeout) {
+		l.observe(c, Observer.Timeout, e)
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		l.observe(c, Observer.Cancelled, e)
+	}
+}
+
+// acquireLockWait waits for lock until it is granted or the timeout or context
+// expire, in the kernel with WithKernelWait. The caller must hold l.mu.
+//
+// The wait runs on a dedicated thread. When the timeout or context expire, the
+// thread is interrupted out of the kernel and the call returns only once the wait
+// is over, so that no goroutine keeps waiting on the lock file after the call. A
+// lock granted just before the interrupt landed is given back without touching
+// what the FileLock held before. Without WithKernelWait, or where waits cannot be
+// interrupted, the lock is polled at a short interval instead.
+//
+// A lock that is free is acquired right away, without starting a wait.
+func (l *FileLock) acquireLockWait(c *config, lock Flock, start time.Time) error {
+	if err := c.ctx.Err(); err != nil {
+		l.failed(c, lock, start, 0, err)
+		return err
+	}
+	if !c.kernel || !l.lk.Interruptible() || !canInterrupt() {
+		pc := *c
+		pc.backoff = fallbackWaitBackoff
+		return l.acquireLock(&pc, lock, start)
+	}
 
-	// Create a Flock_t structure.
-	lock := unix.Flock_t{
-		Type:   unix.F_WRLCK, // write lock
-		Whence: 0,            // relative to the start of the file
-		Start:  0,            // lock starts at byte 0
-		Len:    0,            // lock extends to EOF
+	mode := lock.Mode
+	l.observe(c, Observer.Attempt, Event{Mode: mode, Attempts: 1, Wait: c.since(start)})
+	switch err := l.lk.SetLock(l.file, &lock, false); {
+	case err == nil:
+		l.acquired(c, lock)
+		l.stats.record(1, true)
+		l.observe(c, Observer.Acquired, Event{Mode: mode, Attempts: 1, Wait: c.since(start)})
+		return nil
+	case contended(err):
+		l.observe(c, Observer.Contention, Event{Mode: mode, Attempts: 1, Wait: c.since(start)})
+	}
+
+	// Record the wait in the wait-for graph, if any, and look for a cycle before
+	// and while waiting.
+	wc := l.newWaitCheck(c, lock)
+	defer wc.done()
+	if err := wc.check(); err != nil {
+		l.stats.record(1, false)
+		return err
+	}
+	var checkC <-chan time.Time
+	if wc != nil {
+		checkC = c.clock.After(deadlockCheckInterval)
 	}
 
-	// Start a goroutine to enforce the timeout.
-	timeoutC := time.After(l.config.timeout)
+	// The timeout covers the whole wait in the kernel.
+	timeoutC := c.clock.After(c.timeout)
 
-	destroyC := make(chan struct{})
+	file := l.file
+	var stop atomic.Bool
+	tidC := make(chan int, 1)
 	errC := make(chan error, 1)
 	go func() {
-		// Wait until acquire the lock.
-		errC <- unix.FcntlFlock(l.file.Fd(), unix.F_SETLKW, &lock)
-		select {
-		case <-destroyC:
-			// Immediately release the lock after the lock been acquired.
-			l.Unlock()
-		default:
-			close(destroyC)
+		// Pin the wait to this thread so that it can be interrupted. The thread
+		// exits with the goroutine, taking any interrupt still pending with it.
+		runtime.LockOSThread()
+		tidC <- gettid()
+
+		for {
+			// Wait until acquire the lock.
+			err := l.lk.SetLock(file, &lock, true)
+			if interrupted(err) && !stop.Load() {
+				continue
+			}
+			errC <- err
+			return
 		}
 	}()
+	tid := <-tidC
 
-	select {
-	case <-l.config.ctx.Done():
-		close(destroyC)
-		return fmt.Errorf("acquiring lock context canceled: %w", l.config.ctx.Err())
-	case <-timeoutC:
-		close(destroyC)
-		return ErrTimeout
-	case err := <-errC:
-		if err != nil {
-			return fmt.Errorf("acquiring lock: %w", err)
+	// Check the lease of the holder while waiting, if it may be broken.
+	var leaseC <-chan time.Time
+	if l.breakable(c, lock) {
+		leaseC = c.clock.After(c.lease / leaseRenewals)
+	}
+
+	var canceled error
+wait:
+	for {
+		select {
+		case err := <-errC:
+			if err != nil {
+				l.stats.record(1, false)
+				if kernelDeadlock(err) {
+					return &DeadlockError{Cause: err}
+				}
+				return err
+			}
+			l.acquired(c, lock)
+			l.stats.record(1, true)
+			l.observe(c, Observer.Acquired, Event{Mode: mode, Attempts: 1, Wait: c.since(start)})
+			return nil
+		case <-c.ctx.Done():
+			canceled = c.ctx.Err()
+			break wait
+		case <-timeoutC:
+			break wait
+		case <-leaseC:
+			if l.breakLease(c, lock) {
+				canceled = errLeaseBroken
+				break wait
+			}
+			leaseC = c.clock.After(c.lease / leaseRenewals)
+		case <-checkC:
+			if err := wc.check(); err != nil {
+				canceled = err
+				break wait
+			}
+			checkC = c.clock.After(deadlockCheckInterval)
 		}
-		return nil
 	}
+
+	stop.Store(true)
+	if err := stopWait(tid, errC); err == nil {
+		// The lock was granted before the wait could be interrupted.
+		l.reapply(lock)
+	}
+	if canceled == errLeaseBroken {
+		return canceled
+	}
+	l.stats.record(1, false)
+
+	err := canceled
+	if err == nil {
+		err = l.timeoutError(lock, nil)
+	}
+	l.failed(c, lock, start, 1, err)
+	return err
+}
+
+// breakable reports whether a call configured with c may break the lease of the
+// holder it waits for to acquire lock. The caller must hold l.mu.
+func (l *FileLock) breakable(c *config, lock Flock) bool {
+	return c.lease > 0 && len(l.ranges) == 0 && lock.Start == 0 && lock.Len == maxOffset
 }
 
-func randomDuration(minDuration, maxDuration time.Duration) time.Duration {
-	return minDuration + time.Duration(randomGenerator.Int63n(int64(maxDuration-minDuration)))
+// stopWait interrupts the thread tid until the lock wait running on it gives up,
+// and returns the result of the wait.
+func stopWait(tid int, errC <-chan error) error {
+	for {
+		// os/signal reinstalls the handler with SA_RESTART whenever the handling
+		// of a signal changes, which would make the kernel resume the wait, so
+		// clear the flag again before every interrupt.
+		if !canInterrupt() {
+			return <-errC
+		}
+		if err := interrupt(tid); err != nil {
+			return <-errC
+		}
+		// The interrupt is lost if it arrives before the thread enters the
+		// kernel, so keep sending it until the wait is over. This races the
+		// kernel rather than the deadline, so it runs on real time.
+		select {
+		case err := <-errC:
+			return err
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// newFlock returns a lock request in mode covering length bytes from offset.
+// A length of zero extends the lock to maxOffset, leaving the reserved bytes alone.
+func newFlock(mode Mode, offset, length int64) Flock {
+	if length == 0 && offset < maxOffset {
+		length = maxOffset - offset
+	}
+	return Flock{Mode: mode, Start: offset, Len: length}
 }
@@ -0,0 +1,534 @@
+package filelock
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// Open file description locks are only available on Linux.
+func init() {
+	backends = append(backends, testBackend{name: "ofd", args: []string{"--ofd"}, opts: []Option{WithOFD()}, ranges: true})
+}
+
+func TestFileLock_RLock_kernel(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "target")
+
+			start := time.Now()
+			startHelper(t, append([]string{"wlock", file, "--hold=500ms"}, b.args...)...)
+
+			l, err := New(file, b.opts...)
+			require.NoError(t, err)
+
+			require.ErrorIs(t, l.RLock(WithKernelWait(), WithTimeout(100*time.Millisecond)), ErrTimeout)
+
+			// The reader is woken up by the kernel rather than by its next poll.
+			require.NoError(t, l.RLock(WithKernelWait(), WithTimeout(5*time.Second), WithBackoff(ConstantBackoff(time.Hour))))
+			require.Less(t, time.Since(start), 5*time.Second)
+			require.Equal(t, 1, l.Stats().LastAttempts)
+			require.Equal(t, []Range{{Mode: Shared}}, l.Ranges())
+			require.NoError(t, l.Unlock())
+		})
+	}
+}
+
+func TestFileLock_OFD_sameProcess(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	l1, err := New(file, WithOFD())
+	require.NoError(t, err)
+	l2, err := New(file, WithOFD())
+	require.NoError(t, err)
+
+	require.NoError(t, l1.WLock(WithTimeout(time.Second)))
+	require.ErrorIs(t, l2.RLock(WithTimeout(300*time.Millisecond)), ErrTimeout)
+
+	// Closing an unrelated descriptor of the lock file keeps the OFD lock.
+	l3, err := New(file)
+	require.NoError(t, err)
+	require.NoError(t, l3.Unlock())
+	require.ErrorIs(t, l2.WLock(WithTimeout(300*time.Millisecond)), ErrTimeout)
+
+	require.NoError(t, l1.Unlock())
+	require.NoError(t, l2.WLock(WithTimeout(time.Second)))
+	require.NoError(t, l2.Unlock())
+}
+
+func TestFileLock_Upgrade(t *testing.T) {
+	for _, mode := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "poll"},
+		{name: "block", opts: []Option{WithBlock()}},
+		{name: "kernel", opts: []Option{WithKernelWait()}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "target")
+
+			l1, err := New(file, WithOFD())
+			require.NoError(t, err)
+			l2, err := New(file, WithOFD())
+			require.NoError(t, err)
+
+			require.ErrorIs(t, l1.Upgrade(), ErrNotHeld)
+			require.NoError(t, l1.RLock(WithTimeout(time.Second)))
+			require.NoError(t, l2.RLock(WithTimeout(time.Second)))
+
+			errC := make(chan error, 1)
+			go func() { errC <- l1.Upgrade(append(mode.opts, WithTimeout(5*time.Second))...) }()
+			time.Sleep(200 * time.Millisecond)
+
+			// Both holders upgrading would deadlock, so the second one backs off.
+			require.ErrorIs(t, l2.Upgrade(WithTimeout(time.Second)), ErrUpgradeConflict)
+			require.Equal(t, []Range{{Mode: Shared}}, l2.Ranges())
+			require.NoError(t, l2.Unlock())
+
+			require.NoError(t, <-errC)
+			require.Equal(t, []Range{{Mode: Exclusive}}, l1.Ranges())
+
+			l3, err := New(file, WithOFD())
+			require.NoError(t, err)
+			require.ErrorIs(t, l3.RLock(WithTimeout(300*time.Millisecond)), ErrTimeout)
+
+			require.NoError(t, l1.Downgrade())
+			require.Equal(t, []Range{{Mode: Shared}}, l1.Ranges())
+			require.NoError(t, l3.RLock(WithTimeout(time.Second)))
+			require.ErrorIs(t, l3.Upgrade(WithTimeout(300*time.Millisecond)), ErrTimeout)
+			require.Equal(t, []Range{{Mode: Shared}}, l3.Ranges())
+
+			require.NoError(t, l3.Unlock())
+			require.NoError(t, l1.Unlock())
+		})
+	}
+}
+
+func TestProbe(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	state, err := Probe(file)
+	require.NoError(t, err)
+	require.Equal(t, State{Mode: Unlocked}, state)
+
+	helper := startHelper(t, "rlock", file, "--hold=1s")
+	state, err = Probe(file)
+	require.NoError(t, err)
+	require.Equal(t, State{Mode: Shared, PID: helper.Process.Pid}, state)
+
+	l, err := New(file, WithOFD())
+	require.NoError(t, err)
+	require.NoError(t, l.WLock(WithTimeout(5*time.Second)))
+	defer l.Unlock()
+
+	state, err = Probe(file)
+	require.NoError(t, err)
+	require.Equal(t, State{Mode: Exclusive}, state)
+
+	l2, err := New(file, WithOFD())
+	require.NoError(t, err)
+	state, err = l2.TryInspect()
+	require.NoError(t, err)
+	require.Equal(t, State{Mode: Exclusive}, state)
+
+	state, err = l.TryInspect()
+	require.NoError(t, err)
+	require.Equal(t, State{Mode: Unlocked}, state)
+
+	l3, err := New(file, WithFlock())
+	require.NoError(t, err)
+	_, err = l3.TryInspect()
+	require.ErrorIs(t, err, ErrProbeUnsupported)
+
+	// Probing a lock file the process holds keeps its POSIX locks.
+	owned := filepath.Join(t.TempDir(), "owned")
+	l4, err := New(owned)
+	require.NoError(t, err)
+	defer l4.Close()
+	require.NoError(t, l4.WLock())
+	state, err = Probe(owned)
+	require.NoError(t, err)
+	require.Equal(t, State{Mode: Unlocked}, state)
+	runHelper(t, "timeout", "rlock", owned, "--timeout=100ms")
+}
+
+func TestFileLock_Stats(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	l1, err := New(file, WithOFD())
+	require.NoError(t, err)
+	l2, err := New(file, WithOFD(), WithBackoff(ConstantBackoff(10*time.Millisecond)))
+	require.NoError(t, err)
+
+	require.NoError(t, l1.WLock())
+	require.ErrorIs(t, l2.WLock(WithTimeout(200*time.Millisecond)), ErrTimeout)
+
+	stats := l2.Stats()
+	require.Zero(t, stats.Acquisitions)
+	require.EqualValues(t, 1, stats.Failures)
+	require.Greater(t, stats.LastAttempts, 5)
+	require.EqualValues(t, stats.LastAttempts, stats.Attempts)
+
+	require.NoError(t, l1.Unlock())
+	require.NoError(t, l2.WLock())
+	require.Equal(t, Stats{
+		Acquisitions: 1,
+		Failures:     1,
+		Attempts:     stats.Attempts + 1,
+		LastAttempts: 1,
+	}, l2.Stats())
+	require.NoError(t, l2.Unlock())
+}
+
+func TestFileLock_blockPolling(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	l1, err := New(file)
+	require.NoError(t, err)
+	defer l1.Close()
+	require.NoError(t, l1.WLock())
+
+	// A blocking wait polls and gives up without signaling the process.
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, unix.Signal(63))
+	defer signal.Stop(sigC)
+
+	l2, err := New(file, WithOFD())
+	require.NoError(t, err)
+	defer l2.Close()
+	require.ErrorIs(t, l2.WLock(WithBlock(), WithTimeout(100*time.Millisecond)), ErrTimeout)
+	require.Greater(t, l2.Stats().LastAttempts, 1)
+	select {
+	case sig := <-sigC:
+		t.Fatalf("unexpected signal %v", sig)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestFileLock_perCallOptions(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	l1, err := New(file, WithOFD())
+	require.NoError(t, err)
+	l2, err := New(file, WithOFD(), WithTimeout(300*time.Millisecond), WithBackoff(ConstantBackoff(10*time.Millisecond)))
+	require.NoError(t, err)
+
+	require.NoError(t, l1.WLock())
+	require.ErrorIs(t, l2.WLock(WithTimeout(50*time.Millisecond), WithBlock()), ErrTimeout)
+
+	// The timeout and blocking mode of the previous call do not leak.
+	start := time.Now()
+	require.ErrorIs(t, l2.WLock(), ErrTimeout)
+	require.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+	require.Greater(t, l2.Stats().LastAttempts, 1)
+	require.NoError(t, l1.Unlock())
+
+	require.NoError(t, l2.RLock(WithLabel("first"), WithRemove()))
+	h, err := l2.Holder()
+	require.NoError(t, err)
+	require.Equal(t, "first", h.Label)
+	require.NoError(t, l2.Unlock())
+	require.NoFileExists(t, file+".lock")
+
+	require.NoError(t, l2.RLock())
+	h, err = l2.Holder()
+	require.NoError(t, err)
+	require.Empty(t, h.Label)
+	require.NoError(t, l2.Unlock())
+	require.FileExists(t, file+".lock")
+}
+
+func TestFileLock_kernelCancel(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	l1, err := New(file, WithOFD())
+	require.NoError(t, err)
+	l2, err := New(file, WithOFD())
+	require.NoError(t, err)
+	l3, err := New(file, WithOFD())
+	require.NoError(t, err)
+
+	require.NoError(t, l1.RLock())
+	require.NoError(t, l2.RLock())
+	goroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, l2.Upgrade(WithKernelWait(), WithContext(ctx)), context.DeadlineExceeded)
+	require.ErrorIs(t, l3.WLock(WithKernelWait(), WithTimeout(100*time.Millisecond)), ErrTimeout)
+	require.Equal(t, goroutines, runtime.NumGoroutine())
+
+	// Neither abandoned wait takes the lock once it becomes available, and the
+	// shared lock held before the upgrade is kept.
+	require.NoError(t, l1.Unlock())
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, []Range{{Mode: Shared}}, l2.Ranges())
+	state, err := l1.TryInspect()
+	require.NoError(t, err)
+	require.Equal(t, State{Mode: Shared}, state)
+
+	require.NoError(t, l2.Unlock())
+	require.NoError(t, l3.WLock(WithKernelWait(), WithTimeout(time.Second)))
+	require.NoError(t, l3.Unlock())
+}
+
+func TestFileLock_removeRace(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	l1, err := New(file, WithOFD(), WithRemove())
+	require.NoError(t, err)
+	l2, err := New(file, WithOFD())
+	require.NoError(t, err)
+
+	// l2 opens the lock file before l1 removes it.
+	require.NoError(t, l1.WLock())
+	errC := make(chan error, 1)
+	go func() { errC <- l2.WLock(WithBlock(), WithTimeout(5*time.Second)) }()
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, l1.Unlock())
+	require.NoError(t, <-errC)
+
+	// l2 holds the lock file now at the path, not the removed one.
+	require.FileExists(t, file+".lock")
+	l3, err := New(file, WithOFD())
+	require.NoError(t, err)
+	require.ErrorIs(t, l3.RLock(WithTimeout(100*time.Millisecond)), ErrTimeout)
+
+	// A shared holder does not remove the lock file under other readers.
+	require.NoError(t, l2.Downgrade())
+	require.NoError(t, l3.RLock(WithRemove()))
+	require.NoError(t, l3.Unlock())
+	require.FileExists(t, file+".lock")
+	require.NoError(t, l2.Unlock())
+}
+
+func TestReap(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{"held", "posix", "flock", "orphan"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name+".lock"), nil, 0o600))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "orphan.queue"), nil, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "data"), nil, 0o600))
+
+	held, err := New(filepath.Join(dir, "held"), WithOFD())
+	require.NoError(t, err)
+	require.NoError(t, held.RLock())
+	defer held.Unlock()
+	posix, err := New(filepath.Join(dir, "posix"))
+	require.NoError(t, err)
+	require.NoError(t, posix.WLockRange(10, 1))
+	defer posix.Unlock()
+	flock, err := New(filepath.Join(dir, "flock"), WithFlock())
+	require.NoError(t, err)
+	require.NoError(t, flock.RLock())
+	defer flock.Unlock()
+
+	reaped, err := Reap(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(dir, "orphan.lock"), filepath.Join(dir, "orphan.queue")}, reaped)
+	require.NoFileExists(t, filepath.Join(dir, "orphan.lock"))
+	require.NoFileExists(t, filepath.Join(dir, "orphan.queue"))
+	require.FileExists(t, filepath.Join(dir, "held.lock"))
+	require.FileExists(t, filepath.Join(dir, "posix.lock"))
+	require.FileExists(t, filepath.Join(dir, "flock.lock"))
+	require.FileExists(t, filepath.Join(dir, "data"))
+
+	// The POSIX lock of the process is still held.
+	runHelper(t, "timeout", "wlock", filepath.Join(dir, "posix"), "--range=10:1", "--timeout=100ms")
+}
+
+func TestFileLock_lease(t *testing.T) {
+	for _, block := range []bool{false, true} {
+		t.Run(map[bool]string{false: "poll", true: "kernel"}[block], func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "target")
+
+			// The holder renews its lease far less often than the waiter expects.
+			hung, err := New(file, WithOFD(), WithLease(time.Hour), WithRemove())
+			require.NoError(t, err)
+			l, err := New(file, WithOFD(), WithLease(200*time.Millisecond))
+			require.NoError(t, err)
+
+			require.NoError(t, hung.WLock())
+			require.NotNil(t, hung.LeaseLost())
+			h, err := l.Holder()
+			require.NoError(t, err)
+			require.False(t, h.Heartbeat.IsZero())
+
+			opts := []Option{WithTimeout(5 * time.Second)}
+			if block {
+				opts = append(opts, WithKernelWait())
+			}
+			start := time.Now()
+			require.NoError(t, l.WLock(opts...))
+			require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+			// The hung holder does not remove the lock file that replaced its own.
+			require.NoError(t, hung.Unlock())
+			require.FileExists(t, file+".lock")
+			require.NoError(t, l.Unlock())
+			require.Nil(t, l.LeaseLost())
+		})
+	}
+}
+
+func TestFileLock_leaseClock(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	hung, err := New(file, WithOFD(), WithLease(time.Hour))
+	require.NoError(t, err)
+	defer hung.Close()
+	require.NoError(t, hung.WLock())
+
+	// A waiter in the kernel checks the lease of the holder on its own clock,
+	// which is two hours ahead of the heartbeat.
+	clock := NewFakeClock(time.Now().Add(2 * time.Hour))
+	l, err := New(file, WithOFD(), WithLease(time.Hour), WithClock(clock))
+	require.NoError(t, err)
+	defer l.Close()
+
+	errC := make(chan error, 1)
+	go func() { errC <- l.WLock(WithKernelWait(), WithTimeout(10*time.Hour)) }()
+	clock.BlockUntil(2) // the timeout and the first lease check
+	clock.Advance(time.Hour / leaseRenewals)
+	require.NoError(t, <-errC)
+	require.NoError(t, l.Unlock())
+}
+
+func TestFileLock_leaseRenewed(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	holder, err := New(file, WithOFD(), WithLease(150*time.Millisecond))
+	require.NoError(t, err)
+	l, err := New(file, WithOFD(), WithLease(150*time.Millisecond))
+	require.NoError(t, err)
+
+	// A live holder keeps its lease.
+	require.NoError(t, holder.RLock())
+	require.ErrorIs(t, l.WLock(WithTimeout(500*time.Millisecond)), ErrTimeout)
+
+	// The holder learns when its lock file is taken away.
+	require.NoError(t, os.Remove(file+".lock"))
+	select {
+	case <-holder.LeaseLost():
+	case <-time.After(time.Second):
+		t.Fatal("lease loss not reported")
+	}
+	require.NoError(t, holder.Unlock())
+}
+
+func TestFileLock_leaseShared(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	// A shared lease holder that left does not leave a heartbeat behind for the
+	// writer to break the lock of the remaining reader.
+	reader, err := New(file, WithOFD())
+	require.NoError(t, err)
+	require.NoError(t, reader.RLock())
+	leaser, err := New(file, WithOFD(), WithLease(200*time.Millisecond))
+	require.NoError(t, err)
+	require.NoError(t, leaser.RLock())
+	require.NoError(t, leaser.Unlock())
+
+	writer, err := New(file, WithOFD(), WithLease(200*time.Millisecond))
+	require.NoError(t, err)
+	require.ErrorIs(t, writer.WLock(WithTimeout(600*time.Millisecond)), ErrTimeout)
+	require.NoError(t, reader.Unlock())
+
+	// A stale record of another process does not break the lock of the holder.
+	helper := startHelper(t, "rlock", file, "--hold=1s")
+	f, err := os.OpenFile(file+".lock", os.O_RDWR, 0)
+	require.NoError(t, err)
+	stale := Holder{PID: helper.Process.Pid + 1, Mode: Shared, Heartbeat: time.Now().Add(-time.Hour)}
+	require.NoError(t, writeHolder(f, &stale))
+	require.NoError(t, f.Close())
+	require.ErrorIs(t, writer.WLock(WithTimeout(300*time.Millisecond)), ErrTimeout)
+}
+
+func TestFileLock_fair(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	holder, err := New(file, WithOFD())
+	require.NoError(t, err)
+	require.NoError(t, holder.WLock())
+
+	// A waiter ahead in the queue keeps the ones behind it from the lock, even
+	// once the lock is free, until it leaves the queue.
+	first, err := enqueue(file)
+	require.NoError(t, err)
+
+	order := make(chan int, 3)
+	for i := 1; i <= 3; i++ {
+		l, err := New(file, WithOFD(), WithFair())
+		require.NoError(t, err)
+		go func() {
+			if l.WLock(WithTimeout(5*time.Second)) == nil {
+				order <- i
+				time.Sleep(50 * time.Millisecond)
+				_ = l.Unlock()
+			}
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	require.NoError(t, holder.Unlock())
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, order)
+
+	// A waiter that gives up or dies is skipped.
+	require.NoError(t, first.leave())
+	for i := 1; i <= 3; i++ {
+		require.Equal(t, i, <-order)
+	}
+
+	// An idle queue file is reaped.
+	reaped, err := Reap(filepath.Dir(file))
+	require.NoError(t, err)
+	require.Contains(t, reaped, file+".queue")
+}
+
+func TestFileLock_errors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	l, err := New(file)
+	require.NoError(t, err)
+	require.NoError(t, l.WLock())
+
+	// Waiters in other processes see typed errors on both paths.
+	runHelper(t, "timeout", "rlock", file, "--timeout=100ms")
+	runHelper(t, "timeout", "wlock", file, "--timeout=100ms", "--kernel")
+
+	other, err := New(file, WithOFD())
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = other.WLock(WithContext(ctx), WithKernelWait())
+	require.ErrorIs(t, err, context.Canceled)
+	var lockErr *LockError
+	require.ErrorAs(t, err, &lockErr)
+	require.Equal(t, "WLock", lockErr.Op)
+	require.Equal(t, Exclusive, lockErr.Mode)
+
+	// A polling timeout carries the error of the last attempt.
+	err = other.RLockRange(0, 1, WithTimeout(100*time.Millisecond))
+	require.ErrorIs(t, err, ErrTimeout)
+	require.True(t, errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EACCES), err)
+	require.ErrorAs(t, err, &lockErr)
+	require.Equal(t, "RLockRange", lockErr.Op)
+
+	require.NoError(t, l.Close())
+	err = l.Unlock()
+	require.ErrorIs(t, err, ErrClosed)
+	require.ErrorAs(t, err, &lockErr)
+	require.Equal(t, "Unlock", lockErr.Op)
+	require.EqualError(t, err, "Unlock "+file+": "+ErrClosed.Error())
+}
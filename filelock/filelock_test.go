@@ -1,3 +1,5 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
 package filelock
 
 import (
@@ -10,29 +12,209 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// testBackend is a lock backend exercised by the tests, with the extra helper
+// process arguments and the New options selecting it.
+type testBackend struct {
+	name   string
+	args   []string
+	opts   []Option
+	ranges bool
+}
+
+// backends lists the lock backends available on every platform. The tests for
+// Linux add open file description locks.
+var backends = []testBackend{
+	{name: "posix", ranges: true},
+	{name: "flock", args: []string{"--flock"}, opts: []Option{WithFlock()}},
+}
+
 func TestFileLock_RLock_success(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "target")
+
+			startHelper(t, append([]string{"rlock", file, "--hold=1s"}, b.args...)...)
+
+			l, err := New(file, b.opts...)
+			require.NoError(t, err)
+
+			require.NoError(t, l.RLock(WithTimeout(time.Second)))
+			require.NoError(t, l.Unlock())
+		})
+	}
 }
 
 func TestFileLock_RLock_failed(t *testing.T) {
-	tmpdir, err := os.MkdirTemp(".", "dir-")
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "target")
+
+			startHelper(t, append([]string{"wlock", file, "--hold=2s"}, b.args...)...)
+
+			l, err := New(file, b.opts...)
+			require.NoError(t, err)
+
+			require.ErrorIs(t, l.RLock(WithTimeout(time.Second)), ErrTimeout)
+		})
+	}
+}
+
+func TestFileLock_WLock_success(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "target")
+
+			// The helper waits in F_SETLKW until we release the lock.
+			l, err := New(file, b.opts...)
+			require.NoError(t, err)
+			require.NoError(t, l.WLock(WithTimeout(time.Second)))
+			time.AfterFunc(500*time.Millisecond, func() { _ = l.Unlock() })
+
+			startHelper(t, append([]string{"wlock", file, "--kernel", "--hold=0s"}, b.args...)...)
+		})
+	}
+}
+
+func TestFileLock_WLockRange(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			if !b.ranges {
+				t.Skip("backend does not support byte ranges")
+			}
+			file := filepath.Join(t.TempDir(), "target")
+
+			startHelper(t, append([]string{"wlock", file, "--range=0:10", "--hold=2s"}, b.args...)...)
+
+			l, err := New(file, b.opts...)
+			require.NoError(t, err)
+			defer l.Unlock()
+
+			// Disjoint ranges do not contend.
+			require.NoError(t, l.WLockRange(10, 10, WithTimeout(time.Second)))
+			require.NoError(t, l.RLockRange(20, 0, WithTimeout(time.Second)))
+			require.Equal(t, []Range{
+				{Offset: 10, Length: 10, Mode: Exclusive},
+				{Offset: 20, Length: 0, Mode: Shared},
+			}, l.Ranges())
+
+			// An overlapping range waits for the helper.
+			require.ErrorIs(t, l.WLockRange(5, 10, WithTimeout(500*time.Millisecond)), ErrTimeout)
+
+			require.NoError(t, l.UnlockRange(10, 5))
+			require.Equal(t, []Range{
+				{Offset: 15, Length: 5, Mode: Exclusive},
+				{Offset: 20, Length: 0, Mode: Shared},
+			}, l.Ranges())
+
+			require.ErrorIs(t, l.WLockRange(-1, 10), ErrInvalidRange)
+		})
+	}
+}
+
+func TestFileLock_Flock(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	l, err := New(file, WithFlock())
 	require.NoError(t, err)
+	require.ErrorIs(t, l.WLockRange(0, 10), ErrRangeUnsupported)
+	require.NoError(t, l.WLock(WithTimeout(time.Second), WithBlock()))
+	defer l.Unlock()
 
-	file, err := filepath.Abs(filepath.Join(tmpdir, "target"))
+	// flock locks are per open file description, so they exclude each other
+	// within a single process.
+	l2, err := New(file, WithFlock())
 	require.NoError(t, err)
+	require.ErrorIs(t, l2.RLock(WithTimeout(300*time.Millisecond)), ErrTimeout)
 
-	cmd := exec.Command(os.Args[0], helperProcessArgs("wlock", file)...)
-	cmd.Env = append(os.Environ(), "FILELOCK_HELPER_PROCESS=1")
-	require.NoError(t, cmd.Start())
-	go func() {
-		require.NoError(t, cmd.Wait())
-	}()
+	// They also interoperate with the flock(1) utility.
+	flock, err := exec.LookPath("flock")
+	if err != nil {
+		t.Skip("flock(1) not available")
+	}
+	err = exec.Command(flock, "--nonblock", file+".lock", "true").Run()
+	var exitErr *exec.ExitError
+	require.ErrorAs(t, err, &exitErr)
+}
 
-	time.Sleep(time.Second)
-	l, err := New(file)
+func TestFileLock_reuse(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	l, err := New(file, WithRemove())
 	require.NoError(t, err)
 
+	for i := 0; i < 3; i++ {
+		require.NoError(t, l.WLock(WithTimeout(time.Second)))
+		require.FileExists(t, file+".lock")
+		require.NoError(t, l.Unlock())
+		require.NoFileExists(t, file+".lock")
+		require.NoError(t, l.Unlock())
+
+		// Querying the released lock leaves the lock file removed.
+		h, err := l.Holder()
+		require.NoError(t, err)
+		require.Nil(t, h)
+		state, err := l.TryInspect()
+		require.NoError(t, err)
+		require.Equal(t, State{Mode: Unlocked}, state)
+		require.NoFileExists(t, file+".lock")
+
+		require.NoError(t, l.RLock(WithTimeout(time.Second)))
+		require.NoError(t, l.Unlock())
+	}
+
 	require.NoError(t, l.RLock(WithTimeout(time.Second)))
+	require.NoError(t, l.Close())
+	require.Empty(t, l.Ranges())
+	require.ErrorIs(t, l.Close(), ErrClosed)
+	require.ErrorIs(t, l.WLock(), ErrClosed)
+	require.ErrorIs(t, l.Unlock(), ErrClosed)
+	require.ErrorIs(t, l.Upgrade(), ErrClosed)
 }
 
-func TestFileLock_WLock_success(t *testing.T) {
+func TestFileLock_Holder(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	h, err := Inspect(file)
+	require.NoError(t, err)
+	require.Nil(t, h)
+
+	helper := startHelper(t, "wlock", file, "--label=nightly backup", "--hold=2s")
+
+	h, err = Inspect(file)
+	require.NoError(t, err)
+	require.NotNil(t, h)
+	require.Equal(t, helper.Process.Pid, h.PID)
+	require.Equal(t, Exclusive, h.Mode)
+	require.Equal(t, "nightly backup", h.Label)
+	require.WithinDuration(t, time.Now(), h.Acquired, 10*time.Second)
+
+	l, err := New(file)
+	require.NoError(t, err)
+	err = l.RLock(WithTimeout(300 * time.Millisecond))
+	require.ErrorIs(t, err, ErrTimeout)
+	var lockErr *LockError
+	require.ErrorAs(t, err, &lockErr)
+	require.Equal(t, "RLock", lockErr.Op)
+	require.Equal(t, file, lockErr.Path)
+	require.Equal(t, Shared, lockErr.Mode)
+	require.Equal(t, h, lockErr.Holder)
+	require.Contains(t, err.Error(), "nightly backup")
+
+	require.NoError(t, l.RLock(WithTimeout(5*time.Second), WithLabel("reader")))
+	h, err = l.Holder()
+	require.NoError(t, err)
+	require.Equal(t, os.Getpid(), h.PID)
+	require.Equal(t, Shared, h.Mode)
+	require.Equal(t, "reader", h.Label)
+
+	// Inspecting a lock file the process holds keeps its POSIX locks.
+	h, err = Inspect(file)
+	require.NoError(t, err)
+	require.Nil(t, h)
+	runHelper(t, "timeout", "wlock", file, "--timeout=100ms")
+	require.NoError(t, l.Unlock())
+
+	h, err = l.Holder()
+	require.NoError(t, err)
+	require.Nil(t, h)
 }
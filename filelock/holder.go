@@ -0,0 +1,229 @@
+package filelock
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// holderRecordSize is the size of the holder record at the start of a lock
+	// file. The record is padded to this size so that a single write replaces
+	// it entirely, even when several shared holders write it concurrently.
+	holderRecordSize = 1024
+
+	// maxLabelSize is the maximum number of label bytes kept in the record.
+	maxLabelSize = 512
+)
+
+// Holder describes a process holding a lock, as recorded in the lock file on
+// acquisition.
+//
+// When the record cannot be trusted, for example because the holder did not
+// write one, only the fields known from the kernel are set and PID is zero
+// if the kernel does not report it either.
+//
+// Heartbeat is only set for holders of a lease, see WithLease, and is the time the
+// holder last renewed it.
+type Holder struct {
+	PID       int       `json:"pid"`
+	Hostname  string    `json:"hostname,omitempty"`
+	Acquired  time.Time `json:"acquired"`
+	Heartbeat time.Time `json:"heartbeat"`
+	Mode      Mode      `json:"mode"`
+	Label     string    `json:"label,omitempty"`
+}
+
+func (h *Holder) String() string {
+	var b strings.Builder
+	if h.PID > 0 {
+		fmt.Fprintf(&b, "pid %d", h.PID)
+	} else {
+		b.WriteString("unknown process")
+	}
+	if h.Hostname != "" {
+		fmt.Fprintf(&b, " on %s", h.Hostname)
+	}
+	fmt.Fprintf(&b, " holding %s lock", h.Mode)
+	if !h.Acquired.IsZero() {
+		fmt.Fprintf(&b, " since %s", h.Acquired.Format(time.RFC3339))
+	}
+	if !h.Heartbeat.IsZero() {
+		fmt.Fprintf(&b, ", renewed %s", h.Heartbeat.Format(time.RFC3339))
+	}
+	if h.Label != "" {
+		fmt.Fprintf(&b, " (%s)", h.Label)
+	}
+	return b.String()
+}
+
+// Holder returns the holder of the lock, or nil if nobody holds it.
+//
+// Holders in other processes are found with F_GETLK and described by the record
+// they wrote in the lock file. If only the FileLock itself holds the lock, Holder
+// describes it. With the flock backend, which cannot query holders, Holder trusts
+// the record in the lock file.
+func (l *FileLock) Holder() (*Holder, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var h *Holder
+	err := l.query(func(file *os.File) error {
+		lock := newFlock(Exclusive, 0, 0)
+		var err error
+		switch err = l.lk.GetLock(file, &lock); {
+		case errors.Is(err, ErrProbeUnsupported):
+			h, err = readHolder(file)
+		case err != nil:
+			err = fmt.Errorf("querying lock: %w", err)
+		case lock.Mode == Unlocked:
+			if len(l.ranges) > 0 {
+				h, err = readHolder(file)
+			}
+		default:
+			h = holderOf(file, lock)
+		}
+		return err
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return h, err
+}
+
+// query calls fn with the lock file to query it. While the FileLock holds nothing,
+// the lock file is not open, and fn gets a descriptor of the one at the lock path,
+// which query neither creates nor leaves open; if there is none, query fails with
+// os.ErrNotExist. The caller must hold l.mu.
+func (l *FileLock) query(fn func(file *os.File) error) error {
+	if l.closed {
+		return ErrClosed
+	}
+	if l.file != nil {
+		return fn(l.file)
+	}
+	return withLockFile(l.path+".lock", os.O_RDONLY, func(file *os.File, _ bool) error {
+		return fn(file)
+	})
+}
+
+// Inspect returns the holder of the lock protecting path, or nil if no other
+// process holds it. Locks held by the calling process and flock locks are not
+// visible to Inspect. As Probe, it keeps the descriptor it queries through open
+// while the calling process has the lock file open, so as to keep its POSIX locks.
+func Inspect(path string) (*Holder, error) {
+	if !filepath.IsAbs(path) {
+		return nil, ErrNotAbsolutePath
+	}
+	if posixBackend == nil {
+		return nil, ErrUnsupported
+	}
+
+	var h *Holder
+	err := withLockFile(path+".lock", os.O_RDONLY, func(file *os.File, _ bool) error {
+		lock := newFlock(Exclusive, 0, 0)
+		if err := posixBackend.GetLock(file, &lock); err != nil {
+			return fmt.Errorf("querying lock: %w", err)
+		}
+		if lock.Mode != Unlocked {
+			h = holderOf(file, lock)
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return h, err
+}
+
+// timeoutError returns the error reporting that lock could not be acquired in
+// time, naming the holder of a conflicting lock if it can be found. last is the
+// error of the last attempt, if any. The caller must hold l.mu.
+func (l *FileLock) timeoutError(lock Flock, last error) error {
+	timeoutErr := &LockError{Path: l.path, Cause: ErrTimeout}
+	if last != nil {
+		timeoutErr.Cause = fmt.Errorf("%w: %w", ErrTimeout, last)
+	}
+	switch err := l.lk.GetLock(l.file, &lock); {
+	case errors.Is(err, ErrProbeUnsupported):
+		timeoutErr.Holder, _ = readHolder(l.file)
+	case err == nil && lock.Mode != Unlocked:
+		timeoutErr.Holder = holderOf(l.file, lock)
+	}
+	return timeoutErr
+}
+
+// holderOf describes the holder of the conflicting lock reported by F_GETLK.
+// The record in the lock file is used if it matches the lock; otherwise only the
+// PID and mode reported by the kernel are known.
+func holderOf(file *os.File, conflict Flock) *Holder {
+	h, err := readHolder(file)
+	if err != nil || h == nil || (conflict.Pid > 0 && h.PID != conflict.Pid) {
+		h = &Holder{}
+		if conflict.Pid > 0 {
+			h.PID = conflict.Pid
+		}
+	}
+	h.Mode = conflict.Mode
+	return h
+}
+
+// readHolder reads the holder record from the lock file, returning nil if the
+// file holds no record.
+func readHolder(file *os.File) (*Holder, error) {
+	buf := make([]byte, holderRecordSize)
+	n, err := file.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("reading holder: %w", err)
+	}
+	buf = bytes.TrimSpace(buf[:n])
+	if len(buf) == 0 {
+		return nil, nil
+	}
+
+	var h Holder
+	if err := json.Unmarshal(buf, &h); err != nil {
+		return nil, fmt.Errorf("decoding holder: %w", err)
+	}
+	return &h, nil
+}
+
+// newHolder describes the calling process as a holder of the lock in mode since at.
+func newHolder(mode Mode, label string, at time.Time) *Holder {
+	if len(label) > maxLabelSize {
+		label = label[:maxLabelSize]
+	}
+	hostname, _ := os.Hostname()
+
+	return &Holder{
+		PID:      os.Getpid(),
+		Hostname: hostname,
+		Acquired: at,
+		Mode:     mode,
+		Label:    label,
+	}
+}
+
+// writeHolder writes the holder record of h to the lock file.
+func writeHolder(file *os.File, h *Holder) error {
+	record, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if len(record) >= holderRecordSize {
+		return fmt.Errorf("holder record of %d bytes is too large", len(record))
+	}
+
+	// Pad the record so that it overwrites any longer one in a single write.
+	buf := bytes.Repeat([]byte{' '}, holderRecordSize)
+	copy(buf, record)
+	buf[holderRecordSize-1] = '\n'
+	_, err = file.WriteAt(buf, 0)
+	return err
+}
@@ -0,0 +1,159 @@
+package filelock
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// leaseRenewals is the number of times a holder renews its lease per TTL, so
+// that a late renewal or two does not let the lease expire.
+const leaseRenewals = 3
+
+// errLeaseBroken reports that a waiter broke an expired lease and has to retry
+// with the new lock file.
+var errLeaseBroken = errors.New("lease broken")
+
+// WithLease returns an Option that holds locks on the whole file as leases.
+//
+// The holder of a lease renews a heartbeat in the holder record of the lock file
+// several times per ttl. A waiter that finds the heartbeat older than ttl considers
+// the holder hung and breaks the lease: it removes the lock file, which the hung
+// holder still has locked, and acquires a new one in its place. The holder finds
+// out through the channel returned by LeaseLost.
+//
+// Only waiters acquiring the whole file while holding nothing else break leases,
+// and only those whose holder recorded a heartbeat, so holders and waiters should
+// agree on the ttl.
+func WithLease(ttl time.Duration) Option {
+	return func(c *config) { c.lease = ttl }
+}
+
+// lease is the heartbeat of a lease held by a FileLock.
+type lease struct {
+	stop     chan struct{} // stop is closed to end the heartbeat
+	done     chan struct{} // done is closed once the heartbeat ended
+	lost     chan struct{} // lost is closed when the lease is lost
+	acquired time.Time     // acquired identifies the holder record of the lease
+}
+
+// LeaseLost returns a channel that is closed when the FileLock loses the lease it
+// holds, because a waiter broke it or the heartbeat could not be renewed within
+// the ttl. Once the lease is lost, the lock no longer protects the target and the
+// FileLock should be unlocked. LeaseLost returns nil if no lease is held.
+func (l *FileLock) LeaseLost() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.lease == nil {
+		return nil
+	}
+	return l.lease.lost
+}
+
+// startLease starts renewing the lease described by h, replacing any running
+// heartbeat, with the ttl and clock of c. It does nothing but stop the running one
+// if the ttl is not positive. The caller must hold l.mu.
+func (l *FileLock) startLease(c *config, h *Holder) {
+	l.stopLease()
+	if c.lease <= 0 {
+		return
+	}
+
+	le := &lease{
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		lost:     make(chan struct{}),
+		acquired: h.Acquired,
+	}
+	l.lease = le
+	go le.renew(l.file, l.path+".lock", *h, c.lease, c.clock)
+}
+
+// stopLease stops the heartbeat of the held lease, if any, and waits for it to end.
+// The caller must hold l.mu.
+func (l *FileLock) stopLease() {
+	if l.lease == nil {
+		return
+	}
+	close(l.lease.stop)
+	<-l.lease.done
+	l.lease = nil
+}
+
+// dropLease stops the heartbeat of the held lease, if any, and clears its holder
+// record unless another holder recorded itself since. A shared holder leaves the
+// lock file to the others, and its heartbeat must not outlive it: a waiter would
+// take the stale heartbeat for theirs and break the lock they still hold.
+// The caller must hold l.mu.
+func (l *FileLock) dropLease() {
+	le := l.lease
+	if le == nil {
+		return
+	}
+	l.stopLease()
+
+	h, err := readHolder(l.file)
+	if err == nil && h != nil && h.PID == os.Getpid() && h.Acquired.Equal(le.acquired) {
+		_ = l.file.Truncate(0)
+	}
+}
+
+// renew renews the heartbeat of h in file until stopped or until the lease is lost.
+// It runs without l.mu, which is held while stopping it, so it only uses the file
+// the lease was acquired on.
+func (le *lease) renew(file *os.File, name string, h Holder, ttl time.Duration, clk Clock) {
+	defer close(le.done)
+
+	for {
+		select {
+		case <-le.stop:
+			return
+		case <-clk.After(ttl / leaseRenewals):
+		}
+
+		if ok, err := sameFile(file, name); err == nil && !ok {
+			// A waiter broke the lease and removed the lock file.
+			close(le.lost)
+			return
+		}
+
+		renewed := h
+		renewed.Heartbeat = clk.Now()
+		if err := writeHolder(file, &renewed); err == nil {
+			h = renewed
+		} else if renewed.Heartbeat.Sub(h.Heartbeat) > ttl {
+			close(le.lost)
+			return
+		}
+	}
+}
+
+// breakLease breaks the lease on the lock file if its holder has not renewed it
+// for more than the ttl of c, and reports whether the lock file has to be reopened,
+// either because the lease was broken or because the file was already replaced.
+// The holder record is only trusted if it belongs to the process holding the lock
+// that conflicts with lock, when the kernel tells which one it is.
+// The caller must hold l.mu.
+func (l *FileLock) breakLease(c *config, lock Flock) bool {
+	h, err := readHolder(l.file)
+	if err != nil || h == nil || h.Heartbeat.IsZero() || c.since(h.Heartbeat) <= c.lease {
+		return false
+	}
+	switch err := l.lk.GetLock(l.file, &lock); {
+	case errors.Is(err, ErrProbeUnsupported):
+	case err != nil, lock.Mode == Unlocked, lock.Pid > 0 && lock.Pid != h.PID:
+		return false
+	}
+
+	ok, err := l.current()
+	if err != nil {
+		return false
+	}
+	if ok {
+		if err := os.Remove(l.path + ".lock"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false
+		}
+	}
+	return true
+}
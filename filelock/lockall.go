@@ -0,0 +1,133 @@
+package filelock
+
+import (
+	"cmp"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var ErrInvalidMode = errors.New("invalid lock mode")
+
+// LockSet is a set of locks acquired together by LockAll.
+type LockSet struct {
+	paths []string
+	locks []*FileLock
+	once  sync.Once
+}
+
+// LockAll locks every path of paths in mode, which is Shared or Exclusive, and
+// returns the set of locks held.
+//
+// The paths are locked one at a time in a canonical order: sorted by their real
+// paths, with the symbolic links of their directories resolved, and with duplicates
+// and spellings of the same lock file dropped. Two callers locking overlapping sets
+// with LockAll therefore never wait on each other in a cycle, however they spell
+// the paths. The directories of the paths must exist.
+//
+// The options apply to every lock, with the timeout and context covering LockAll as
+// a whole rather than each lock. If a lock cannot be acquired, the locks already
+// taken are released and the error names the path that failed.
+func LockAll(paths []string, mode Mode, opts ...Option) (*LockSet, error) {
+	if mode != Shared && mode != Exclusive {
+		return nil, ErrInvalidMode
+	}
+
+	type entry struct {
+		real string // real is the path with the links of its directory resolved
+		path string // path is the path as spelled by the caller, cleaned
+	}
+	sorted := make([]entry, 0, len(paths))
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			return nil, ErrNotAbsolutePath
+		}
+		path = filepath.Clean(path)
+		dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+		if err != nil {
+			return nil, lockError("LockAll", path, mode, err)
+		}
+		sorted = append(sorted, entry{real: filepath.Join(dir, filepath.Base(path)), path: path})
+	}
+	slices.SortFunc(sorted, func(a, b entry) int {
+		return cmp.Or(strings.Compare(a.real, b.real), strings.Compare(a.path, b.path))
+	})
+	sorted = slices.CompactFunc(sorted, func(a, b entry) bool { return a.real == b.real })
+
+	c := newConfig(opts)
+	deadline := c.clock.Now().Add(c.timeout)
+
+	s := &LockSet{}
+	seen := make(map[fileKey]bool, len(sorted))
+	for _, e := range sorted {
+		path := e.path
+
+		// A second name of a lock file already in the set, through a hard link
+		// or a bind mount, is skipped before opening it: the descriptor would
+		// share the POSIX locks of the set, and closing it would drop them.
+		if fi, err := os.Stat(path + ".lock"); err == nil && seen[keyOf(fi)] {
+			continue
+		}
+
+		l, err := New(path, opts...)
+		if err != nil {
+			return nil, s.rollback(lockError("LockAll", path, mode, err))
+		}
+
+		lockOpts := append(opts[:len(opts):len(opts)], WithTimeout(deadline.Sub(c.clock.Now())))
+		if mode == Exclusive {
+			err = l.WLock(lockOpts...)
+		} else {
+			err = l.RLock(lockOpts...)
+		}
+		if err != nil {
+			_ = l.Close()
+			return nil, s.rollback(lockError("LockAll", path, mode, err))
+		}
+
+		s.paths = append(s.paths, path)
+		s.locks = append(s.locks, l)
+		key, err := l.fileKey()
+		if err != nil {
+			return nil, s.rollback(lockError("LockAll", path, mode, err))
+		}
+		seen[key] = true
+	}
+
+	return s, nil
+}
+
+// Paths returns the paths locked by the set, in the order they were locked.
+func (s *LockSet) Paths() []string {
+	return slices.Clone(s.paths)
+}
+
+// Unlock releases every lock of the set, in the reverse order they were locked.
+// Only the first call has an effect; later calls return ErrNotHeld.
+func (s *LockSet) Unlock() error {
+	err := ErrNotHeld
+	s.once.Do(func() {
+		err = s.release()
+	})
+	return err
+}
+
+// rollback releases the locks taken so far and returns err.
+func (s *LockSet) rollback(err error) error {
+	if rerr := s.release(); rerr != nil {
+		return errors.Join(err, rerr)
+	}
+	return err
+}
+
+// release closes the locks of the set in reverse order.
+func (s *LockSet) release() error {
+	var errs []error
+	for _, l := range slices.Backward(s.locks) {
+		errs = append(errs, l.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,72 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package filelock
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockAll(t *testing.T) {
+	dir := t.TempDir()
+	a, b, c := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")
+
+	_, err := LockAll([]string{a}, Unlocked)
+	require.ErrorIs(t, err, ErrInvalidMode)
+	_, err = LockAll([]string{"a"}, Exclusive)
+	require.ErrorIs(t, err, ErrNotAbsolutePath)
+
+	s, err := LockAll([]string{c, a, filepath.Join(dir, ".", "c"), b}, Exclusive)
+	require.NoError(t, err)
+	require.Equal(t, []string{a, b, c}, s.Paths())
+
+	for _, path := range []string{a, b, c} {
+		runHelper(t, "timeout", "rlock", path, "--timeout=100ms")
+	}
+
+	require.NoError(t, s.Unlock())
+	require.ErrorIs(t, s.Unlock(), ErrNotHeld)
+
+	s, err = LockAll([]string{a, b, c}, Shared)
+	require.NoError(t, err)
+	require.NoError(t, s.Unlock())
+
+	// A spelling through a symlink is dropped without touching the POSIX lock
+	// taken through the first one.
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "real"), 0o700))
+	require.NoError(t, os.Symlink("real", filepath.Join(dir, "link")))
+	target, alias := filepath.Join(dir, "real", "x"), filepath.Join(dir, "link", "x")
+	s, err = LockAll([]string{target, alias}, Exclusive)
+	require.NoError(t, err)
+	require.Equal(t, []string{alias}, s.Paths())
+	runHelper(t, "timeout", "rlock", target, "--timeout=100ms")
+	require.NoError(t, s.Unlock())
+
+	// The order follows the real paths, however they are spelled.
+	first, second := filepath.Join(dir, "real", "a"), filepath.Join(dir, "link", "b")
+	s, err = LockAll([]string{second, first}, Exclusive)
+	require.NoError(t, err)
+	require.Equal(t, []string{first, second}, s.Paths())
+	require.NoError(t, s.Unlock())
+
+	_, err = LockAll([]string{filepath.Join(dir, "missing", "a")}, Exclusive)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLockAll_rollback(t *testing.T) {
+	dir := t.TempDir()
+	a, b, c := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")
+
+	startHelper(t, "wlock", b, "--hold=1s")
+
+	_, err := LockAll([]string{a, b, c}, Exclusive, WithTimeout(200*time.Millisecond))
+	require.ErrorIs(t, err, ErrTimeout)
+	require.ErrorContains(t, err, b)
+
+	// The lock taken on a before failing on b was released.
+	startHelper(t, "wlock", a, "--timeout=100ms", "--hold=0s")
+}
@@ -0,0 +1,233 @@
+package filelock
+
+import (
+	"container/list"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const defaultCacheSize = 64
+
+var ErrInvalidName = errors.New("invalid lock name")
+
+// WithCacheSize returns an Option that sets how many idle lock files a Manager keeps
+// open for reuse. Lock files held or waited for are always open and do not count.
+// It is only consulted by NewManager.
+func WithCacheSize(n int) Option {
+	return func(c *config) { c.cacheSize = n }
+}
+
+// Manager hands out named locks rooted at a directory. The lock named name
+// protects the path name in the directory, with its lock file next to it.
+//
+// Manager locks coordinate with the goroutines of the process the same way RWLock
+// does, and with the RWLock values on the same paths. Lock files that nobody holds
+// or waits for are kept open for reuse, up to the cache size, and closed least
+// recently used first.
+type Manager struct {
+	dir       string
+	opts      []Option
+	cacheSize int
+
+	mu      sync.Mutex
+	entries map[string]*managedName
+	idle    *list.List // idle entries, most recently used first
+	closed  bool
+}
+
+// managedName is the state a Manager keeps for a name.
+type managedName struct {
+	name string
+	lock *managedLock  // lock is the lock file shared with the rest of the process
+	refs int           // refs counts the handles and waiters, guarded by Manager.mu
+	elem *list.Element // elem is the entry in the idle list, guarded by Manager.mu
+}
+
+// Handle is a lock held through a Manager or an RWLock.
+type Handle struct {
+	name string
+	e    *managedLock
+	mode Mode
+	put  func() error // put drops the reference the handle holds to e
+	once sync.Once
+}
+
+// NewManager returns a Manager for the locks in dir, which must be an absolute path
+// to an existing directory.
+//
+// The options are the defaults of every lock handed out by the Manager, and may be
+// overridden per call.
+func NewManager(dir string, opts ...Option) (*Manager, error) {
+	if !filepath.IsAbs(dir) {
+		return nil, ErrNotAbsolutePath
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	return &Manager{
+		dir:       dir,
+		opts:      opts,
+		cacheSize: newConfig(opts).cacheSize,
+		entries:   make(map[string]*managedName),
+		idle:      list.New(),
+	}, nil
+}
+
+// RLock acquires a shared lock on name. It accepts the same options as FileLock.RLock,
+// and the timeout and context cover the wait for other goroutines as well.
+func (m *Manager) RLock(name string, opts ...Option) (*Handle, error) {
+	h, err := m.lock(name, Shared, opts)
+	return h, lockError("RLock", filepath.Join(m.dir, name), Shared, err)
+}
+
+// WLock acquires an exclusive lock on name. It accepts the same options as
+// FileLock.WLock, and the timeout and context cover the wait for other goroutines
+// as well.
+func (m *Manager) WLock(name string, opts ...Option) (*Handle, error) {
+	h, err := m.lock(name, Exclusive, opts)
+	return h, lockError("WLock", filepath.Join(m.dir, name), Exclusive, err)
+}
+
+// Close closes the idle lock files. The lock files of outstanding handles are closed
+// when they are unlocked, and later calls to RLock and WLock fail with ErrClosed.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+	m.closed = true
+
+	var errs []error
+	for m.idle.Len() > 0 {
+		errs = append(errs, m.evict(m.idle.Back()))
+	}
+	return errors.Join(errs...)
+}
+
+// Name returns the name the handle locks: the name passed to the Manager, or the
+// target path for a handle of an RWLock.
+func (h *Handle) Name() string { return h.name }
+
+// Mode returns the mode the handle holds the lock in.
+func (h *Handle) Mode() Mode { return h.mode }
+
+// Unlock releases the lock held by the handle. Only the first call has an effect.
+func (h *Handle) Unlock() error {
+	err := ErrNotHeld
+	h.once.Do(func() {
+		err = errors.Join(h.e.unlock(h.mode), h.put())
+	})
+	return err
+}
+
+func (m *Manager) lock(name string, mode Mode, opts []Option) (*Handle, error) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return nil, ErrInvalidName
+	}
+
+	// The lock file may have been opened with the options of an RWLock, so the
+	// options of the Manager go with every call.
+	opts = append(m.opts[:len(m.opts):len(m.opts)], opts...)
+	c := newConfig(opts)
+	deadline := c.clock.Now().Add(c.timeout)
+
+	for {
+		n, err := m.get(name)
+		if err != nil {
+			return nil, err
+		}
+
+		err = n.lock.lock(mode, c, deadline, opts)
+		if err == nil {
+			return &Handle{
+				name: name,
+				e:    n.lock,
+				mode: mode,
+				put:  func() error { m.put(n); return nil },
+			}, nil
+		}
+
+		stale := errors.Is(err, errStale)
+		if stale {
+			m.forget(n)
+		}
+		m.put(n)
+		if !stale {
+			return nil, err
+		}
+	}
+}
+
+// get returns the entry of name, creating it if needed, and takes a reference to it.
+func (m *Manager) get(name string) (*managedName, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	n, ok := m.entries[name]
+	if !ok {
+		e, err := openShared(filepath.Join(m.dir, name), m.opts)
+		if err != nil {
+			return nil, err
+		}
+		n = &managedName{name: name, lock: e}
+		m.entries[name] = n
+	}
+	if n.elem != nil {
+		m.idle.Remove(n.elem)
+		n.elem = nil
+	}
+	n.refs++
+	return n, nil
+}
+
+// put drops a reference to n, caching its lock file once it is idle.
+func (m *Manager) put(n *managedName) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n.refs--
+	if n.refs > 0 {
+		return
+	}
+	if m.entries[n.name] != n {
+		// The entry was forgotten, so it is not to be reused.
+		_ = closeShared(n.lock)
+		return
+	}
+
+	n.elem = m.idle.PushFront(n)
+	limit := m.cacheSize
+	if m.closed {
+		limit = 0
+	}
+	for m.idle.Len() > max(limit, 0) {
+		_ = m.evict(m.idle.Back())
+	}
+}
+
+// forget stops reusing n, whose lock file was replaced.
+func (m *Manager) forget(n *managedName) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.entries[n.name] == n {
+		delete(m.entries, n.name)
+	}
+}
+
+// evict closes the lock file of an idle entry and forgets it.
+// The caller must hold m.mu.
+func (m *Manager) evict(elem *list.Element) error {
+	n := m.idle.Remove(elem).(*managedName)
+	delete(m.entries, n.name)
+	return closeShared(n.lock)
+}
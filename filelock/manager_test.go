@@ -0,0 +1,73 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package filelock
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := NewManager(dir, WithCacheSize(1))
+	require.NoError(t, err)
+	defer m.Close()
+
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		_, err := m.WLock(name)
+		require.ErrorIs(t, err, ErrInvalidName, name)
+	}
+
+	// Goroutines of the same process exclude each other on a name.
+	w, err := m.WLock("a")
+	require.NoError(t, err)
+	require.Equal(t, Exclusive, w.Mode())
+	_, err = m.RLock("a", WithTimeout(100*time.Millisecond))
+	require.ErrorIs(t, err, ErrTimeout)
+	require.NoError(t, w.Unlock())
+	require.ErrorIs(t, w.Unlock(), ErrNotHeld)
+
+	// Readers share a single lock file.
+	r1, err := m.RLock("a")
+	require.NoError(t, err)
+	r2, err := m.RLock("a")
+	require.NoError(t, err)
+	require.Len(t, m.entries, 1)
+	require.NoError(t, r1.Unlock())
+	_, err = m.WLock("a", WithTimeout(100*time.Millisecond))
+	require.ErrorIs(t, err, ErrTimeout)
+	require.NoError(t, r2.Unlock())
+
+	// Only one idle lock file is kept open.
+	b, err := m.WLock("b")
+	require.NoError(t, err)
+	require.Len(t, m.entries, 2)
+	require.NoError(t, b.Unlock())
+	require.Len(t, m.entries, 1)
+	require.Contains(t, m.entries, "b")
+}
+
+func TestManager_crossProcess(t *testing.T) {
+	dir := t.TempDir()
+
+	startHelper(t, "wlock", filepath.Join(dir, "shared"), "--hold=1s")
+
+	m, err := NewManager(dir)
+	require.NoError(t, err)
+	defer m.Close()
+
+	_, err = m.RLock("shared", WithTimeout(100*time.Millisecond))
+	require.ErrorIs(t, err, ErrTimeout)
+
+	h, err := m.WLock("shared", WithTimeout(5*time.Second))
+	require.NoError(t, err)
+	require.NoError(t, h.Unlock())
+
+	require.NoError(t, m.Close())
+	_, err = m.WLock("shared")
+	require.ErrorIs(t, err, ErrClosed)
+}
@@ -0,0 +1,38 @@
+package filelock
+
+import "time"
+
+// Observer receives the events of lock acquisitions and releases, to measure or
+// trace them. It is called synchronously from the lock calls, so its methods must
+// be quick and must not call back into the FileLock.
+//
+// An Observer set with WithObserver on New sees every call of the FileLock; one
+// passed to a single call only sees that call and the release of what it acquired.
+type Observer interface {
+	// Attempt is called before each attempt to acquire the lock.
+	Attempt(Event)
+
+	// Contention is called when an attempt finds the lock held by others.
+	Contention(Event)
+
+	// Acquired is called once the lock is acquired.
+	Acquired(Event)
+
+	// Timeout is called when the acquisition gives up at the timeout.
+	Timeout(Event)
+
+	// Cancelled is called when the acquisition gives up because its context is done.
+	Cancelled(Event)
+
+	// Released is called when the FileLock releases the last byte it held.
+	Released(Event)
+}
+
+// Event describes the progress of a lock acquisition, or a release.
+type Event struct {
+	Path     string        // Path is the target path of the lock
+	Mode     Mode          // Mode is the mode requested, or the strongest one released
+	Attempts int           // Attempts is the number of attempts made so far
+	Wait     time.Duration // Wait is the time waited so far, or the time held on release
+	Err      error         // Err is the error returned on timeout or cancellation
+}
@@ -0,0 +1,123 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package filelock
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is an Observer that records the kinds of events it receives, only
+// once per acquisition for the attempts and contention repeated by polling.
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+	seen   map[string]bool
+	last   map[string]Event
+}
+
+func (r *recorder) record(kind string, e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.last == nil {
+		r.seen = make(map[string]bool)
+		r.last = make(map[string]Event)
+	}
+	r.last[kind] = e
+	if kind != "attempt" && kind != "contention" {
+		clear(r.seen)
+	} else if r.seen[kind] {
+		return
+	}
+	r.seen[kind] = true
+	r.events = append(r.events, kind)
+}
+
+func (r *recorder) Attempt(e Event)    { r.record("attempt", e) }
+func (r *recorder) Contention(e Event) { r.record("contention", e) }
+func (r *recorder) Acquired(e Event)   { r.record("acquired", e) }
+func (r *recorder) Timeout(e Event)    { r.record("timeout", e) }
+func (r *recorder) Cancelled(e Event)  { r.record("cancelled", e) }
+func (r *recorder) Released(e Event)   { r.record("released", e) }
+
+func TestFileLock_observer(t *testing.T) {
+	for _, block := range []bool{false, true} {
+		t.Run(map[bool]string{false: "poll", true: "kernel"}[block], func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "target")
+
+			startHelper(t, "wlock", file, "--hold=500ms")
+
+			r := &recorder{}
+			l, err := New(file, WithObserver(r))
+			require.NoError(t, err)
+
+			opts := []Option{WithTimeout(100 * time.Millisecond)}
+			if block {
+				opts = append(opts, WithKernelWait())
+			}
+			require.ErrorIs(t, l.WLock(opts...), ErrTimeout)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			require.Error(t, l.WLock(append(opts, WithContext(ctx))...))
+
+			opts = append(opts, WithTimeout(5*time.Second))
+			require.NoError(t, l.RLock(opts...))
+			require.NoError(t, l.Unlock())
+
+			require.Equal(t, []string{
+				"attempt", "contention", "timeout", "cancelled",
+				"attempt", "contention", "acquired", "released",
+			}, r.events)
+			require.ErrorIs(t, r.last["timeout"].Err, ErrTimeout)
+			require.ErrorIs(t, r.last["cancelled"].Err, context.Canceled)
+
+			acquired := r.last["acquired"]
+			require.Equal(t, file, acquired.Path)
+			require.Equal(t, Shared, acquired.Mode)
+			require.Greater(t, acquired.Wait, 200*time.Millisecond)
+			require.Equal(t, Shared, r.last["released"].Mode)
+		})
+	}
+}
+
+// expvarRuns numbers the runs of TestExpvarObserver, since expvar names are
+// published for the life of the test binary.
+var expvarRuns atomic.Int64
+
+func TestExpvarObserver(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	name := fmt.Sprintf("%s_%d", t.Name(), expvarRuns.Add(1))
+	o := NewExpvarObserver(name)
+	l, err := New(file, WithObserver(o))
+	require.NoError(t, err)
+	require.NoError(t, l.WLock())
+	require.NoError(t, l.Unlock())
+
+	var vars struct {
+		Attempts     int `json:"attempts"`
+		Acquisitions int `json:"acquisitions"`
+		Releases     int `json:"releases"`
+		Wait         struct {
+			Count int     `json:"count"`
+			Fast  int     `json:"le_1"`
+			Sum   float64 `json:"sum"`
+		} `json:"wait_seconds"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get(name).String()), &vars))
+	require.Equal(t, 1, vars.Attempts)
+	require.Equal(t, 1, vars.Acquisitions)
+	require.Equal(t, 1, vars.Releases)
+	require.Equal(t, 1, vars.Wait.Count)
+	require.Equal(t, 1, vars.Wait.Fast)
+}
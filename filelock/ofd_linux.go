@@ -0,0 +1,11 @@
+package filelock
+
+import "golang.org/x/sys/unix"
+
+// ofdBackend uses open file description locks, which are owned by the open
+// file description rather than by the process.
+var ofdBackend Backend = fcntlBackend{
+	getlk:  unix.F_OFD_GETLK,
+	setlk:  unix.F_OFD_SETLK,
+	setlkw: unix.F_OFD_SETLKW,
+}
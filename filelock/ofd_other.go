@@ -0,0 +1,6 @@
+//go:build !linux
+
+package filelock
+
+// ofdBackend is nil on platforms without open file description locks.
+var ofdBackend Backend
@@ -0,0 +1,86 @@
+package filelock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// State describes how a lock is held by others, as reported by the kernel.
+type State struct {
+	Mode Mode // Mode is Unlocked, Shared or Exclusive
+	PID  int  // PID is a process holding the lock, 0 if unlocked or unknown
+}
+
+// Probe reports the state of the lock protecting path without acquiring it.
+//
+// Probe queries the kernel with F_GETLK and never changes the lock, so it is safe
+// to call from health checks and tools while others contend for it. It sees POSIX
+// and open file description locks held by other processes, but neither the locks of
+// the calling process nor flock locks. The PID of an open file description lock is
+// not known and is reported as 0.
+//
+// If the calling process has the lock file open, through a FileLock for instance,
+// the descriptor Probe queries through is kept open until the process closes the
+// file: closing it would drop the POSIX locks of the process.
+func Probe(path string) (State, error) {
+	if !filepath.IsAbs(path) {
+		return State{}, ErrNotAbsolutePath
+	}
+	if posixBackend == nil {
+		return State{}, ErrUnsupported
+	}
+
+	var state State
+	err := withLockFile(path+".lock", os.O_RDONLY, func(file *os.File, _ bool) error {
+		var err error
+		state, err = probe(posixBackend, file)
+		return err
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return State{Mode: Unlocked}, nil
+	}
+	return state, err
+}
+
+// TryInspect reports the state of the lock as held by others, without acquiring it.
+//
+// Unlike Probe, TryInspect queries through the backend of the FileLock, so with open
+// file description locks it also sees other FileLock values in the calling process.
+// It fails with ErrProbeUnsupported for the flock backend.
+func (l *FileLock) TryInspect() (State, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var state State
+	err := l.query(func(file *os.File) error {
+		var err error
+		state, err = probe(l.lk, file)
+		return err
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return State{Mode: Unlocked}, nil
+	}
+	return state, err
+}
+
+// probe queries the state of the whole lock file.
+func probe(b Backend, file *os.File) (State, error) {
+	// A read lock only conflicts with write locks, so query for one first to tell
+	// an exclusive holder apart from shared ones.
+	for _, mode := range []Mode{Shared, Exclusive} {
+		lock := newFlock(mode, 0, 0)
+		if err := b.GetLock(file, &lock); err != nil {
+			if errors.Is(err, ErrProbeUnsupported) {
+				return State{}, err
+			}
+			return State{}, fmt.Errorf("querying lock: %w", err)
+		}
+		if lock.Mode != Unlocked {
+			return State{Mode: lock.Mode, PID: max(lock.Pid, 0)}, nil
+		}
+	}
+
+	return State{Mode: Unlocked}, nil
+}
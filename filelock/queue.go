@@ -0,0 +1,155 @@
+package filelock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// queueHeaderSize is the size of the ticket counter at the start of a queue file.
+// The tickets are the bytes that follow it, one per waiter.
+const queueHeaderSize = 8
+
+// errQueueRemoved reports that the queue file was removed before a ticket could be
+// drawn from it.
+var errQueueRemoved = errors.New("queue file removed")
+
+// WithFair returns an Option that makes waiters take the lock in arrival order.
+//
+// Before waiting for the lock, a fair waiter draws a ticket from a queue file next to
+// the lock file, with the same name plus a ".queue" extension, and holds a lock on
+// the byte of its ticket for as long as it waits. It only goes for the lock once no
+// earlier ticket is held any more, so a waiter that gave up or died, and with it its
+// ticket lock, is skipped.
+//
+// Only fair waiters queue up, so every party should use WithFair, and only calls on
+// a FileLock that holds nothing queue up. Waiters of one process are ordered only
+// where open file description locks are available; RWLock orders them otherwise.
+func WithFair() Option {
+	return func(c *config) { c.fair = true }
+}
+
+// ticket is the place of a waiter in the queue of a lock.
+type ticket struct {
+	file *os.File
+	lk   Backend
+	n    int64 // n is the number of tickets drawn before this one
+}
+
+// enqueue draws a ticket from the queue file of path.
+func enqueue(path string) (*ticket, error) {
+	for {
+		t, err := drawTicket(path + ".queue")
+		if !errors.Is(err, errQueueRemoved) {
+			return t, err
+		}
+	}
+}
+
+// drawTicket draws a ticket from the queue file at name.
+func drawTicket(name string) (*ticket, error) {
+	file, err := openLockFile(name, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &ticket{file: file, lk: localBackend()}
+	if err := t.draw(name); err != nil {
+		_ = closeLockFile(file)
+		return nil, err
+	}
+	return t, nil
+}
+
+// draw increments the ticket counter of the queue file at name and locks the byte
+// of the ticket drawn.
+func (t *ticket) draw(name string) error {
+	counter := newFlock(Exclusive, 0, queueHeaderSize)
+	if err := t.lk.SetLock(t.file, &counter, true); err != nil {
+		return fmt.Errorf("locking queue: %w", err)
+	}
+	defer func() {
+		counter.Mode = Unlocked
+		_ = t.lk.SetLock(t.file, &counter, false)
+	}()
+
+	// Reap removes an idle queue file while holding its counter.
+	ok, err := sameFile(t.file, name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errQueueRemoved
+	}
+
+	buf := make([]byte, queueHeaderSize)
+	if _, err := t.file.ReadAt(buf, 0); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("reading queue: %w", err)
+	}
+	t.n = int64(binary.LittleEndian.Uint64(buf))
+	binary.LittleEndian.PutUint64(buf, uint64(t.n+1))
+	if _, err := t.file.WriteAt(buf, 0); err != nil {
+		return fmt.Errorf("writing queue: %w", err)
+	}
+
+	mark := newFlock(Exclusive, queueHeaderSize+t.n, 1)
+	if err := t.lk.SetLock(t.file, &mark, false); err != nil {
+		return fmt.Errorf("locking ticket: %w", err)
+	}
+	return nil
+}
+
+// head reports whether no earlier ticket of the queue is held any more.
+func (t *ticket) head() (bool, error) {
+	if t.n == 0 {
+		return true, nil
+	}
+
+	earlier := newFlock(Exclusive, queueHeaderSize, t.n)
+	if err := t.lk.GetLock(t.file, &earlier); err != nil {
+		return false, fmt.Errorf("querying queue: %w", err)
+	}
+	return earlier.Mode == Unlocked, nil
+}
+
+// wait waits until the ticket reaches the head of the queue, polling at a short
+// interval, or until the context of c is done or deadline passes on its clock.
+func (t *ticket) wait(c *config, deadline time.Time) error {
+	timeoutC := c.clock.After(deadline.Sub(c.clock.Now()))
+
+	var delay time.Duration
+	for attempt := 1; ; attempt++ {
+		ok, err := t.head()
+		if ok || err != nil {
+			return err
+		}
+
+		delay = c.nextDelay(fallbackWaitBackoff, attempt, delay)
+		select {
+		case <-timeoutC:
+			return ErrTimeout
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		case <-c.clock.After(delay):
+		}
+	}
+}
+
+// leave gives the ticket up, letting the waiters behind it move on.
+func (t *ticket) leave() error {
+	// Closing the queue file drops the lock on the ticket.
+	return closeLockFile(t.file)
+}
+
+// localBackend returns the fcntl backend for the files the package locks on its
+// own: OFD locks where available, which also separate the descriptors of the
+// calling process, and POSIX locks otherwise.
+func localBackend() Backend {
+	if ofdBackend != nil {
+		return ofdBackend
+	}
+	return posixBackend
+}
@@ -0,0 +1,156 @@
+package filelock
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+var ErrInvalidRange = errors.New("invalid lock range")
+
+const (
+	// maxOffset is the end of the byte range available to callers. The bytes
+	// from maxOffset to the end of the offset space are reserved for the locks
+	// a FileLock takes internally to coordinate with other holders, so that
+	// they never conflict with a caller's lock, even one extending to EOF.
+	maxOffset = math.MaxInt64 - reservedBytes
+
+	// reservedBytes is the number of bytes reserved above maxOffset.
+	reservedBytes = 8
+
+	// upgradeOffset is the reserved byte held exclusively while upgrading a
+	// shared lock, so that two holders never wait on each other to upgrade.
+	upgradeOffset = maxOffset
+)
+
+// Mode describes how a lock, or a byte range of it, is held.
+type Mode int
+
+const (
+	Unlocked  Mode = iota // no lock is held
+	Shared                // a read lock that other readers may share
+	Exclusive             // a write lock that excludes every other holder
+)
+
+func (m Mode) String() string {
+	switch m {
+	case Unlocked:
+		return "unlocked"
+	case Shared:
+		return "shared"
+	case Exclusive:
+		return "exclusive"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (m Mode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (m *Mode) UnmarshalText(text []byte) error {
+	for _, mode := range []Mode{Unlocked, Shared, Exclusive} {
+		if string(text) == mode.String() {
+			*m = mode
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown lock mode %q", text)
+}
+
+// Range is a byte range held by a FileLock.
+//
+// A Length of zero means the range extends to the end of the file, however
+// large the file grows, following the fcntl convention.
+type Range struct {
+	Offset int64
+	Length int64
+	Mode   Mode
+}
+
+// validateRange reports whether offset and length describe a lockable range.
+func validateRange(offset, length int64) error {
+	if offset < 0 || length < 0 || offset >= maxOffset || length > maxOffset-offset {
+		return ErrInvalidRange
+	}
+	return nil
+}
+
+// span is a half-open byte interval [start, end) held in a single mode.
+// An end of maxOffset means the span extends to EOF.
+type span struct {
+	start, end int64
+	mode       Mode
+}
+
+func newSpan(offset, length int64, mode Mode) span {
+	end := int64(maxOffset)
+	if length != 0 {
+		end = offset + length
+	}
+	return span{start: offset, end: end, mode: mode}
+}
+
+func (s span) toRange() Range {
+	length := s.end - s.start
+	if s.end == maxOffset {
+		length = 0
+	}
+	return Range{Offset: s.start, Length: length, Mode: s.mode}
+}
+
+// rangeSet mirrors the byte ranges the kernel records for a lock file.
+//
+// Like fcntl, setting a range replaces whatever part of the existing ranges
+// it overlaps, and neighbouring ranges held in the same mode are coalesced.
+// The spans are kept sorted by start offset and never overlap.
+type rangeSet []span
+
+// set records s, replacing any overlapped ranges. Setting a span in the
+// Unlocked mode removes the covered bytes from the set.
+func (rs rangeSet) set(s span) rangeSet {
+	out := make(rangeSet, 0, len(rs)+2)
+	for _, e := range rs {
+		if e.end <= s.start || e.start >= s.end {
+			out = append(out, e)
+			continue
+		}
+		if e.start < s.start {
+			out = append(out, span{start: e.start, end: s.start, mode: e.mode})
+		}
+		if e.end > s.end {
+			out = append(out, span{start: s.end, end: e.end, mode: e.mode})
+		}
+	}
+	if s.mode != Unlocked {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].start < out[j].start })
+
+	// Coalesce adjacent spans held in the same mode.
+	merged := out[:0]
+	for _, e := range out {
+		if n := len(merged); n > 0 && merged[n-1].end == e.start && merged[n-1].mode == e.mode {
+			merged[n-1].end = e.end
+			continue
+		}
+		merged = append(merged, e)
+	}
+	return merged
+}
+
+// ranges returns the set as a list of Range values.
+func (rs rangeSet) ranges() []Range {
+	if len(rs) == 0 {
+		return nil
+	}
+	out := make([]Range, len(rs))
+	for i, s := range rs {
+		out[i] = s.toRange()
+	}
+	return out
+}
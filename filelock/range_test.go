@@ -0,0 +1,50 @@
+package filelock
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeSet(t *testing.T) {
+	var rs rangeSet
+
+	rs = rs.set(newSpan(0, 100, Shared))
+	rs = rs.set(newSpan(20, 10, Exclusive))
+	require.Equal(t, rangeSet{
+		{start: 0, end: 20, mode: Shared},
+		{start: 20, end: 30, mode: Exclusive},
+		{start: 30, end: 100, mode: Shared},
+	}, rs)
+
+	// Downgrading the middle coalesces the whole range again.
+	rs = rs.set(newSpan(20, 10, Shared))
+	require.Equal(t, rangeSet{{start: 0, end: 100, mode: Shared}}, rs)
+
+	rs = rs.set(newSpan(50, 0, Exclusive))
+	require.Equal(t, rangeSet{
+		{start: 0, end: 50, mode: Shared},
+		{start: 50, end: maxOffset, mode: Exclusive},
+	}, rs)
+	require.Equal(t, []Range{
+		{Offset: 0, Length: 50, Mode: Shared},
+		{Offset: 50, Length: 0, Mode: Exclusive},
+	}, rs.ranges())
+
+	rs = rs.set(newSpan(10, 0, Unlocked))
+	require.Equal(t, rangeSet{{start: 0, end: 10, mode: Shared}}, rs)
+
+	rs = rs.set(newSpan(0, 0, Unlocked))
+	require.Empty(t, rs)
+}
+
+func TestValidateRange(t *testing.T) {
+	require.NoError(t, validateRange(0, 0))
+	require.NoError(t, validateRange(10, maxOffset-10))
+	require.ErrorIs(t, validateRange(-1, 0), ErrInvalidRange)
+	require.ErrorIs(t, validateRange(0, -1), ErrInvalidRange)
+	require.ErrorIs(t, validateRange(11, maxOffset-10), ErrInvalidRange)
+	require.ErrorIs(t, validateRange(maxOffset, 0), ErrInvalidRange)
+	require.ErrorIs(t, validateRange(10, math.MaxInt64-10), ErrInvalidRange)
+}
@@ -0,0 +1,96 @@
+package filelock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Reap removes the orphaned lock files in dir: those left behind by holders that
+// exited or crashed and that no live process holds any more, along with the queue
+// files of WithFair that nobody waits in. It returns the paths of the removed lock
+// and queue files, along with any errors met on the way.
+//
+// A lock file is only removed while Reap holds it exclusively with both fcntl and
+// flock locks, so lock files in use by any backend are left alone. The lock and
+// queue files the calling process has open are left alone as well.
+func Reap(dir string) ([]string, error) {
+	if localBackend() == nil || flockBackend == nil {
+		return nil, ErrUnsupported
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var reaped []string
+	var errs []error
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasSuffix(name, ".lock") && !strings.HasSuffix(name, ".queue") {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		ok, err := reap(path)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if ok {
+			reaped = append(reaped, path)
+		}
+	}
+
+	return reaped, errors.Join(errs...)
+}
+
+// reap removes the lock or queue file at path if nobody holds it. A file the
+// calling process has open is left alone.
+func reap(path string) (bool, error) {
+	var reaped bool
+	err := withLockFile(path, os.O_RDWR, func(file *os.File, held bool) error {
+		if held {
+			return nil
+		}
+		var err error
+		reaped, err = reapFile(file, path)
+		return err
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return reaped, err
+}
+
+// reapFile removes the file at path, open as file, if nobody holds it.
+func reapFile(file *os.File, path string) (bool, error) {
+	b := localBackend()
+
+	// Lock every byte, including the reserved ones, and the flock lock as well,
+	// since flock and fcntl locks do not see each other.
+	lock := Flock{Mode: Exclusive}
+	if b.SetLock(file, &lock, false) != nil {
+		return false, nil
+	}
+	whole := newFlock(Exclusive, 0, 0)
+	if flockBackend.SetLock(file, &whole, false) != nil {
+		return false, nil
+	}
+
+	// Make sure the file at path is still the one locked.
+	fi, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	pi, err := os.Stat(path)
+	if err != nil || !os.SameFile(fi, pi) {
+		return false, nil
+	}
+
+	if err := os.Remove(path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
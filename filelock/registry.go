@@ -0,0 +1,289 @@
+package filelock
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// errStale reports that the lock file of an entry was replaced by another process
+// and that the process already has the new one open under another entry.
+var errStale = errors.New("lock file replaced")
+
+// fileKey identifies a lock file by device and inode, however its path is spelled.
+type fileKey struct {
+	dev, ino uint64
+}
+
+// registry tracks the lock files opened by RWLock and Manager in the process, so that
+// each lock file is opened once and the goroutines using it take turns in memory.
+//
+// Opening a lock file twice would not only let the goroutines of the process hold
+// the same POSIX lock at once, but closing either descriptor would also drop the
+// locks held through the other.
+var registry = struct {
+	mu      sync.Mutex
+	entries map[fileKey]*managedLock
+}{entries: make(map[fileKey]*managedLock)}
+
+// lockFiles tracks the descriptors the process has open on lock and queue files,
+// by device and inode. The functions that look at a lock file by path, such as
+// Probe and Reap, go through it so as never to open and close a second descriptor
+// on a lock file of the process: closing it would drop the POSIX locks the process
+// holds through the first.
+var lockFiles = struct {
+	mu     sync.Mutex
+	keys   map[*os.File]fileKey   // keys identifies the lock file of each descriptor
+	files  map[fileKey][]*os.File // files lists the open descriptors of each lock file
+	parked map[fileKey][]*os.File // parked are descriptors to close with the last one
+}{
+	keys:   make(map[*os.File]fileKey),
+	files:  make(map[fileKey][]*os.File),
+	parked: make(map[fileKey][]*os.File),
+}
+
+// openLockFile opens the lock or queue file at name like os.OpenFile, and tracks
+// the descriptor until it is closed with closeLockFile.
+func openLockFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	lockFiles.mu.Lock()
+	defer lockFiles.mu.Unlock()
+
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	key := keyOf(fi)
+	lockFiles.keys[file] = key
+	lockFiles.files[key] = append(lockFiles.files[key], file)
+	return file, nil
+}
+
+// closeLockFile closes a descriptor opened with openLockFile. Closing the last
+// descriptor of a lock file also closes those parked on it.
+func closeLockFile(file *os.File) error {
+	lockFiles.mu.Lock()
+	defer lockFiles.mu.Unlock()
+
+	key, ok := lockFiles.keys[file]
+	if !ok {
+		return file.Close()
+	}
+	delete(lockFiles.keys, file)
+	files := slices.DeleteFunc(lockFiles.files[key], func(f *os.File) bool { return f == file })
+	if len(files) > 0 {
+		lockFiles.files[key] = files
+		return file.Close()
+	}
+	delete(lockFiles.files, key)
+	for _, f := range lockFiles.parked[key] {
+		_ = f.Close()
+	}
+	delete(lockFiles.parked, key)
+	return file.Close()
+}
+
+// withLockFile calls fn with a descriptor of the lock or queue file at name that
+// holds no locks. If the process has the file open, held is true and fn gets a
+// descriptor parked on the file, which stays open until the process closes the
+// file, since closing it would drop the POSIX locks of the process; fn must then
+// neither lock nor close it. Otherwise the file is opened with flag for fn and
+// closed afterwards. The descriptors of the process stay open until fn returns,
+// and fn must not block.
+func withLockFile(name string, flag int, fn func(file *os.File, held bool) error) error {
+	lockFiles.mu.Lock()
+	defer lockFiles.mu.Unlock()
+
+	if fi, err := os.Stat(name); err == nil {
+		key := keyOf(fi)
+		if len(lockFiles.files[key]) > 0 && len(lockFiles.parked[key]) > 0 {
+			return fn(lockFiles.parked[key][0], true)
+		}
+	}
+
+	file, err := os.OpenFile(name, flag, 0)
+	if err != nil {
+		return err
+	}
+	if fi, err := file.Stat(); err == nil {
+		if key := keyOf(fi); len(lockFiles.files[key]) > 0 {
+			// The descriptors of the process may hold open file description
+			// locks, which a query through them would not see, so query through
+			// the new one and keep it until the process closes the file.
+			lockFiles.parked[key] = append(lockFiles.parked[key], file)
+			return fn(file, true)
+		}
+	}
+	defer file.Close()
+
+	return fn(file, false)
+}
+
+// managedLock is a lock file shared by the goroutines of the process.
+type managedLock struct {
+	key  fileKey     // key identifies the open lock file, guarded by registry.mu
+	fl   *FileLock   // fl is the lock on the file, never released with Unlock
+	rw   fairRWMutex // rw orders the goroutines using the lock file
+	refs int         // refs counts the users of the entry, guarded by registry.mu
+
+	mu      sync.Mutex // mu guards the lock on the file
+	readers int        // readers counts the goroutines sharing the lock on the file
+}
+
+// openShared returns the entry of the lock file of path and takes a reference to it.
+// Unless the process already has the lock file open, it is opened with opts.
+func openShared(path string, opts []Option) (*managedLock, error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if fi, err := os.Stat(path + ".lock"); err == nil {
+		if e, ok := registry.entries[keyOf(fi)]; ok {
+			e.refs++
+			return e, nil
+		}
+	}
+
+	fl, err := New(path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	key, err := fl.fileKey()
+	if err != nil {
+		_ = fl.Close()
+		return nil, err
+	}
+
+	e := &managedLock{key: key, fl: fl, refs: 1}
+	registry.entries[key] = e
+	return e, nil
+}
+
+// closeShared drops a reference to e, closing its lock file once nobody uses it.
+func closeShared(e *managedLock) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	e.refs--
+	if e.refs > 0 {
+		return nil
+	}
+	if registry.entries[e.key] == e {
+		delete(registry.entries, e.key)
+	}
+	return e.fl.Close()
+}
+
+// lock locks e in mode on behalf of the calling goroutine, first in memory and then
+// on the lock file, giving up once the context of c is done or deadline passes.
+func (e *managedLock) lock(mode Mode, c *config, deadline time.Time, opts []Option) error {
+	if err := e.rw.lock(c.ctx, c.clock, deadline, mode == Exclusive); err != nil {
+		return err
+	}
+
+	opts = append(opts[:len(opts):len(opts)], WithTimeout(deadline.Sub(c.clock.Now())))
+	if err := e.lockFile(mode, opts); err != nil {
+		e.rw.unlock(mode == Exclusive)
+		return err
+	}
+	return nil
+}
+
+// unlock releases the lock e.lock acquired in mode, keeping the lock file open.
+func (e *managedLock) unlock(mode Mode) error {
+	err := e.unlockFile(mode)
+	e.rw.unlock(mode == Exclusive)
+	return err
+}
+
+// lockFile locks the file of e in mode on behalf of a goroutine that holds e.rw.
+func (e *managedLock) lockFile(mode Mode, opts []Option) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if mode == Shared && e.readers > 0 {
+		e.readers++
+		return nil
+	}
+
+	var err error
+	if mode == Exclusive {
+		err = e.fl.WLock(opts...)
+	} else {
+		err = e.fl.RLock(opts...)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := e.rekey(); err != nil {
+		_ = e.fl.UnlockRange(0, 0)
+		return err
+	}
+	if mode == Shared {
+		e.readers++
+	}
+	return nil
+}
+
+// unlockFile releases the lock of a goroutine on the file of e, keeping the file
+// open for reuse.
+func (e *managedLock) unlockFile(mode Mode) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if mode == Shared {
+		e.readers--
+		if e.readers > 0 {
+			return nil
+		}
+	}
+	return e.fl.UnlockRange(0, 0)
+}
+
+// rekey registers e under the identity of its lock file, which changes when the
+// FileLock finds out that the previous holder removed the file and opens the new
+// one. It fails with errStale if the process already opened the new lock file
+// under another entry, in which case that entry is to be used instead.
+func (e *managedLock) rekey() error {
+	key, err := e.fl.fileKey()
+	if err != nil {
+		return err
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if key == e.key {
+		return nil
+	}
+	if registry.entries[e.key] == e {
+		delete(registry.entries, e.key)
+	}
+	if _, ok := registry.entries[key]; ok {
+		return errStale
+	}
+	e.key = key
+	registry.entries[key] = e
+	return nil
+}
+
+// fileKey returns the identity of the open lock file.
+func (l *FileLock) fileKey() (fileKey, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return fileKey{}, ErrClosed
+	}
+	fi, err := l.file.Stat()
+	if err != nil {
+		return fileKey{}, err
+	}
+	return keyOf(fi), nil
+}
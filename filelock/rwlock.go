@@ -0,0 +1,86 @@
+package filelock
+
+import (
+	"errors"
+	"path/filepath"
+)
+
+// RWLock is a reader/writer lock on a target path that excludes the other goroutines
+// of the process as well as other processes.
+//
+// POSIX record locks belong to the process, so two FileLock values for the same path
+// in one process never exclude each other. RWLock values instead share a process-wide
+// registry of lock files keyed by device and inode, so the RWLock values of a path,
+// even one spelled differently, and the Manager locks on it take turns in memory,
+// in arrival order, before locking the file. As with sync.RWMutex, readers share
+// the lock and a writer excludes everyone else.
+//
+// The lock file is opened with the options of the first RWLock or Manager to use
+// it, and closed once no goroutine holds or waits for it.
+type RWLock struct {
+	path string
+	opts []Option
+}
+
+// NewRWLock returns an RWLock on path, which must be absolute.
+//
+// The options are the defaults of every lock acquired through the RWLock, and may be
+// overridden per call.
+func NewRWLock(path string, opts ...Option) (*RWLock, error) {
+	if !filepath.IsAbs(path) {
+		return nil, ErrNotAbsolutePath
+	}
+	if newConfig(opts).backend == nil {
+		return nil, ErrUnsupported
+	}
+
+	return &RWLock{path: path, opts: opts}, nil
+}
+
+// RLock acquires a shared lock on the target. It accepts the same options as
+// FileLock.RLock, and the timeout and context cover the wait for other goroutines
+// as well.
+func (l *RWLock) RLock(opts ...Option) (*Handle, error) {
+	h, err := l.lock(Shared, opts)
+	return h, lockError("RLock", l.path, Shared, err)
+}
+
+// WLock acquires an exclusive lock on the target. It accepts the same options as
+// FileLock.WLock, and the timeout and context cover the wait for other goroutines
+// as well.
+func (l *RWLock) WLock(opts ...Option) (*Handle, error) {
+	h, err := l.lock(Exclusive, opts)
+	return h, lockError("WLock", l.path, Exclusive, err)
+}
+
+func (l *RWLock) lock(mode Mode, opts []Option) (*Handle, error) {
+	// The lock file may have been opened with the options of another RWLock,
+	// so the options of this one go with every call.
+	opts = append(l.opts[:len(l.opts):len(l.opts)], opts...)
+	c := newConfig(opts)
+	deadline := c.clock.Now().Add(c.timeout)
+
+	for {
+		e, err := openShared(l.path, l.opts)
+		if err != nil {
+			return nil, err
+		}
+
+		err = e.lock(mode, c, deadline, opts)
+		if err == nil {
+			return &Handle{
+				name: l.path,
+				e:    e,
+				mode: mode,
+				put:  func() error { return closeShared(e) },
+			}, nil
+		}
+
+		if cerr := closeShared(e); cerr != nil {
+			err = errors.Join(err, cerr)
+		}
+		if !errors.Is(err, errStale) {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,126 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package filelock
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRWLock(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "real"), 0o700))
+	require.NoError(t, os.Symlink("real", filepath.Join(dir, "link")))
+
+	// Two spellings of the same target share the lock file.
+	a, err := NewRWLock(filepath.Join(dir, "real", "target"))
+	require.NoError(t, err)
+	b, err := NewRWLock(filepath.Join(dir, "link", "target"))
+	require.NoError(t, err)
+
+	w, err := a.WLock()
+	require.NoError(t, err)
+	_, err = b.WLock(WithTimeout(100 * time.Millisecond))
+	require.ErrorIs(t, err, ErrTimeout)
+	_, err = b.RLock(WithTimeout(100 * time.Millisecond))
+	require.ErrorIs(t, err, ErrTimeout)
+	require.NoError(t, w.Unlock())
+	require.ErrorIs(t, w.Unlock(), ErrNotHeld)
+
+	r1, err := a.RLock()
+	require.NoError(t, err)
+	r2, err := b.RLock()
+	require.NoError(t, err)
+	_, err = b.WLock(WithTimeout(100 * time.Millisecond))
+	require.ErrorIs(t, err, ErrTimeout)
+
+	// A waiting writer gets the lock once the readers are gone.
+	done := make(chan error, 1)
+	go func() {
+		h, err := b.WLock(WithTimeout(5 * time.Second))
+		if err == nil {
+			err = h.Unlock()
+		}
+		done <- err
+	}()
+	require.NoError(t, r1.Unlock())
+	require.NoError(t, r2.Unlock())
+	require.NoError(t, <-done)
+
+	// The wait for other goroutines times out on the clock of the call.
+	w, err = a.WLock()
+	require.NoError(t, err)
+	clock := NewFakeClock(time.Now())
+	go func() {
+		_, err := b.RLock(WithClock(clock), WithTimeout(time.Minute))
+		done <- err
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	require.ErrorIs(t, <-done, ErrTimeout)
+	require.NoError(t, w.Unlock())
+
+	// Manager locks on the same path take part as well.
+	m, err := NewManager(filepath.Join(dir, "real"))
+	require.NoError(t, err)
+	defer m.Close()
+	h, err := m.WLock("target")
+	require.NoError(t, err)
+	_, err = a.RLock(WithTimeout(100 * time.Millisecond))
+	require.ErrorIs(t, err, ErrTimeout)
+	require.NoError(t, h.Unlock())
+	require.NoError(t, m.Close())
+
+	// The lock file is closed once unused.
+	fi, err := os.Stat(filepath.Join(dir, "real", "target.lock"))
+	require.NoError(t, err)
+	registry.mu.Lock()
+	require.NotContains(t, registry.entries, keyOf(fi))
+	registry.mu.Unlock()
+}
+
+func TestRWLock_crossProcess(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	startHelper(t, "wlock", file, "--hold=1s")
+
+	l, err := NewRWLock(file)
+	require.NoError(t, err)
+
+	_, err = l.RLock(WithTimeout(100 * time.Millisecond))
+	require.ErrorIs(t, err, ErrTimeout)
+
+	h, err := l.WLock(WithTimeout(5 * time.Second))
+	require.NoError(t, err)
+	require.NoError(t, h.Unlock())
+}
+
+func TestRWLock_options(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "target")
+
+	// The Manager keeps the lock file open with its own options.
+	m, err := NewManager(dir, WithTimeout(time.Hour))
+	require.NoError(t, err)
+	defer m.Close()
+	h, err := m.WLock("target")
+	require.NoError(t, err)
+	require.NoError(t, h.Unlock())
+
+	startHelper(t, "wlock", file, "--hold=1s")
+
+	// The options of the RWLock still apply to the wait for the lock file.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	l, err := NewRWLock(file, WithContext(ctx), WithTimeout(5*time.Second))
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = l.WLock()
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), time.Second)
+}
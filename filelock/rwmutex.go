@@ -0,0 +1,115 @@
+package filelock
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// fairRWMutex is a reader/writer mutex that grants the lock in arrival order, so
+// that a steady stream of readers cannot starve a writer and vice versa. Unlike
+// sync.RWMutex, waiters can give up when their context or deadline expire.
+type fairRWMutex struct {
+	mu      sync.Mutex
+	readers int        // number of readers holding the lock
+	writer  bool       // whether a writer holds the lock
+	queue   *list.List // waiters in arrival order, as *rwWaiter
+}
+
+// rwWaiter is a goroutine waiting for a fairRWMutex.
+type rwWaiter struct {
+	write bool
+	ready chan struct{} // closed once the lock is granted
+}
+
+// lock acquires m for writing if write is true and for reading otherwise, waiting
+// until the lock is granted, ctx is done or deadline passes on clk.
+func (m *fairRWMutex) lock(ctx context.Context, clk Clock, deadline time.Time, write bool) error {
+	m.mu.Lock()
+	if m.queue == nil {
+		m.queue = list.New()
+	}
+	if m.queue.Len() == 0 && m.compatible(write) {
+		m.grant(write)
+		m.mu.Unlock()
+		return nil
+	}
+	w := &rwWaiter{write: write, ready: make(chan struct{})}
+	elem := m.queue.PushBack(w)
+	m.mu.Unlock()
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-clk.After(deadline.Sub(clk.Now())):
+		err = ErrTimeout
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-w.ready:
+		// The lock was granted while giving up, so hand it on.
+		m.release(write)
+	default:
+		m.queue.Remove(elem)
+	}
+	m.promote()
+	return err
+}
+
+// unlock releases m, which the caller holds for writing if write is true and for
+// reading otherwise.
+func (m *fairRWMutex) unlock(write bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.release(write)
+	m.promote()
+}
+
+// compatible reports whether the lock can be granted right away.
+// The caller must hold m.mu.
+func (m *fairRWMutex) compatible(write bool) bool {
+	if write {
+		return !m.writer && m.readers == 0
+	}
+	return !m.writer
+}
+
+// grant records the lock as held. The caller must hold m.mu.
+func (m *fairRWMutex) grant(write bool) {
+	if write {
+		m.writer = true
+	} else {
+		m.readers++
+	}
+}
+
+// release records the lock as no longer held. The caller must hold m.mu.
+func (m *fairRWMutex) release(write bool) {
+	if write {
+		m.writer = false
+	} else {
+		m.readers--
+	}
+}
+
+// promote grants the lock to waiters at the head of the queue for as long as they
+// are compatible with the holders. The caller must hold m.mu.
+func (m *fairRWMutex) promote() {
+	for m.queue != nil && m.queue.Len() > 0 {
+		elem := m.queue.Front()
+		w := elem.Value.(*rwWaiter)
+		if !m.compatible(w.write) {
+			return
+		}
+		m.grant(w.write)
+		m.queue.Remove(elem)
+		close(w.ready)
+	}
+}
@@ -0,0 +1,50 @@
+package filelock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFairRWMutex(t *testing.T) {
+	var m fairRWMutex
+	ctx := context.Background()
+	forever := time.Now().Add(time.Hour)
+
+	require.NoError(t, m.lock(ctx, systemClock{}, forever, true))
+
+	// Queue a reader, a writer and another reader behind the writer.
+	order := make(chan string, 3)
+	lock := func(name string, write bool) {
+		go func() {
+			if m.lock(ctx, systemClock{}, forever, write) == nil {
+				order <- name
+			}
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	lock("r1", false)
+	lock("w2", true)
+	lock("r3", false)
+
+	// A waiter that gives up leaves the queue.
+	require.ErrorIs(t, m.lock(ctx, systemClock{}, time.Now().Add(20*time.Millisecond), false), ErrTimeout)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, m.lock(canceled, systemClock{}, forever, true), context.Canceled)
+
+	// The late reader does not overtake the waiting writer.
+	m.unlock(true)
+	require.Equal(t, "r1", <-order)
+	require.Empty(t, order)
+	m.unlock(false)
+	require.Equal(t, "w2", <-order)
+	m.unlock(true)
+	require.Equal(t, "r3", <-order)
+	m.unlock(false)
+
+	require.NoError(t, m.lock(ctx, systemClock{}, forever, true))
+	m.unlock(true)
+}
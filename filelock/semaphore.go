@@ -0,0 +1,223 @@
+package filelock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var ErrNoSlot = errors.New("no free semaphore slot")
+
+// Semaphore limits a resource to n concurrent holders across processes.
+//
+// The slots of the semaphore are the first n bytes of the lock file, each held with
+// an exclusive byte range lock, so a slot is freed by the kernel when its holder
+// exits or crashes. Every process using the semaphore must agree on n.
+//
+// A Semaphore may be shared by the goroutines of a process. As with FileLock,
+// separate Semaphore values for the same path only exclude each other with WithOFD.
+type Semaphore struct {
+	l *FileLock
+	n int
+}
+
+// NewSemaphore returns a semaphore of n slots protecting path, which must be absolute.
+//
+// The options are the defaults of every acquisition, and may be overridden per call.
+// The backend must support byte ranges, so WithFlock fails with ErrRangeUnsupported.
+func NewSemaphore(path string, n int, opts ...Option) (*Semaphore, error) {
+	if n <= 0 || int64(n) > maxOffset {
+		return nil, fmt.Errorf("semaphore of %d slots: %w", n, ErrInvalidRange)
+	}
+
+	l, err := New(path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if !l.lk.Ranges() {
+		_ = l.Close()
+		return nil, ErrRangeUnsupported
+	}
+
+	return &Semaphore{l: l, n: n}, nil
+}
+
+// Acquire takes a free slot and returns its number, waiting until one is freed
+// if all are taken. It accepts the same timeout, context and backoff options as
+// FileLock.WLock. WithBlock and WithKernelWait both poll at a short interval
+// instead of the backoff, since no single kernel wait covers every slot.
+func (s *Semaphore) Acquire(opts ...Option) (int, error) {
+	slot, err := s.acquire(opts)
+	return slot, lockError("Acquire", s.l.path, Exclusive, err)
+}
+
+func (s *Semaphore) acquire(opts []Option) (int, error) {
+	c := s.l.options(opts)
+	if err := c.ctx.Err(); err != nil {
+		return -1, err
+	}
+	backoff := c.backoff
+	if c.block {
+		backoff = fallbackWaitBackoff
+	}
+
+	// The timeout covers every attempt, along with the delays between them.
+	timeoutC := c.clock.After(c.timeout)
+
+	var delay time.Duration
+	for attempt := 1; ; attempt++ {
+		slot, err := s.take(c)
+		if !errors.Is(err, ErrNoSlot) {
+			s.record(attempt, err == nil)
+			return slot, err
+		}
+
+		// Wait for a while for the next retry.
+		delay = c.nextDelay(backoff, attempt, delay)
+		select {
+		case <-timeoutC:
+			s.record(attempt, false)
+			return -1, ErrTimeout
+		case <-c.ctx.Done():
+			s.record(attempt, false)
+			return -1, c.ctx.Err()
+		case <-c.clock.After(delay):
+		}
+	}
+}
+
+// TryAcquire takes a free slot and returns its number without waiting. It fails
+// with ErrNoSlot if all slots are taken.
+func (s *Semaphore) TryAcquire() (int, error) {
+	slot, err := s.take(s.l.config)
+	s.record(1, err == nil)
+	return slot, lockError("TryAcquire", s.l.path, Exclusive, err)
+}
+
+// Release frees slot, which the Semaphore must hold.
+func (s *Semaphore) Release(slot int) error {
+	return lockError("Release", s.l.path, Unlocked, s.release(slot))
+}
+
+func (s *Semaphore) release(slot int) error {
+	if slot < 0 || slot >= s.n {
+		return fmt.Errorf("slot %d: %w", slot, ErrInvalidRange)
+	}
+
+	l := s.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	if !s.holds(slot) {
+		return ErrNotHeld
+	}
+	return l.release(int64(slot), 1)
+}
+
+// Slots reports the state of every slot, indexed by slot number. Slots held by the
+// Semaphore itself are reported as held exclusively by the calling process.
+func (s *Semaphore) Slots() ([]State, error) {
+	l := s.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	states := make([]State, s.n)
+	err := l.query(func(file *os.File) error {
+		for i := range states {
+			if s.holds(i) {
+				states[i] = State{Mode: Exclusive, PID: os.Getpid()}
+				continue
+			}
+			lock := newFlock(Exclusive, int64(i), 1)
+			if err := l.lk.GetLock(file, &lock); err != nil {
+				return fmt.Errorf("querying lock: %w", err)
+			}
+			states[i] = State{Mode: lock.Mode, PID: max(lock.Pid, 0)}
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// Without a lock file, every slot is free.
+		clear(states)
+	case err != nil:
+		return nil, err
+	}
+	return states, nil
+}
+
+// Close releases the slots held by the Semaphore and closes its lock file. Every
+// later call fails with ErrClosed.
+func (s *Semaphore) Close() error {
+	return s.l.Close()
+}
+
+// take takes the first free slot, failing with ErrNoSlot if there is none.
+func (s *Semaphore) take(c *config) (int, error) {
+	l := s.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for {
+		if err := l.open(); err != nil {
+			return -1, err
+		}
+		fresh := len(l.ranges) == 0
+
+		slot := -1
+		for i := 0; i < s.n && slot < 0; i++ {
+			if s.holds(i) {
+				continue
+			}
+			lock := newFlock(Exclusive, int64(i), 1)
+			err := l.lk.SetLock(l.file, &lock, false)
+			switch {
+			case err == nil:
+				l.acquired(c, lock)
+				slot = i
+			case !contended(err):
+				return -1, err
+			}
+		}
+		if slot < 0 {
+			return -1, ErrNoSlot
+		}
+		if !fresh {
+			return slot, nil
+		}
+
+		// As in FileLock.acquire, a slot of a removed lock file limits nothing.
+		ok, err := l.current()
+		if ok || err != nil {
+			return slot, err
+		}
+		_ = closeLockFile(l.file)
+		l.file = nil
+		l.ranges = nil
+		l.acq = nil
+		l.syncGraph()
+	}
+}
+
+// holds reports whether the Semaphore holds slot.
+// The caller must hold s.l.mu.
+func (s *Semaphore) holds(slot int) bool {
+	for _, e := range s.l.ranges {
+		if e.start <= int64(slot) && int64(slot) < e.end {
+			return true
+		}
+	}
+	return false
+}
+
+// record counts an acquisition in the stats of the lock file.
+func (s *Semaphore) record(attempts int, ok bool) {
+	s.l.mu.Lock()
+	defer s.l.mu.Unlock()
+
+	s.l.stats.record(attempts, ok)
+}
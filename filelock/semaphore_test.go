@@ -0,0 +1,58 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package filelock
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSemaphore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "target")
+
+	_, err := NewSemaphore(file, 0)
+	require.ErrorIs(t, err, ErrInvalidRange)
+	_, err = NewSemaphore(file, 2, WithFlock())
+	require.ErrorIs(t, err, ErrRangeUnsupported)
+
+	cmd := startHelper(t, "wlock", file, "--range=0:1", "--hold=1s")
+
+	s, err := NewSemaphore(file, 2)
+	require.NoError(t, err)
+	defer s.Close()
+
+	slot, err := s.TryAcquire()
+	require.NoError(t, err)
+	require.Equal(t, 1, slot)
+	_, err = s.TryAcquire()
+	require.ErrorIs(t, err, ErrNoSlot)
+	_, err = s.Acquire(WithTimeout(100 * time.Millisecond))
+	require.ErrorIs(t, err, ErrTimeout)
+
+	states, err := s.Slots()
+	require.NoError(t, err)
+	require.Equal(t, []State{
+		{Mode: Exclusive, PID: cmd.Process.Pid},
+		{Mode: Exclusive, PID: os.Getpid()},
+	}, states)
+
+	require.NoError(t, s.Release(1))
+	require.ErrorIs(t, s.Release(1), ErrNotHeld)
+	require.ErrorIs(t, s.Release(2), ErrInvalidRange)
+
+	// A slot freed by another process is taken once available.
+	slot, err = s.Acquire(WithBlock(), WithTimeout(5*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 1, slot)
+	slot, err = s.Acquire(WithBlock(), WithTimeout(5*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 0, slot)
+
+	require.NoError(t, s.Close())
+	_, err = s.TryAcquire()
+	require.ErrorIs(t, err, ErrClosed)
+}
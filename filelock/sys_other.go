@@ -0,0 +1,15 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package filelock
+
+import "os"
+
+// The functions below are never reached, since no lock file can be locked on this
+// platform.
+
+func busy(error) bool           { return false }
+func interrupted(error) bool    { return false }
+func kernelDeadlock(error) bool { return false }
+func exited(int) bool           { return false }
+
+func keyOf(os.FileInfo) fileKey { return fileKey{} }
@@ -0,0 +1,37 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package filelock
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// busy reports whether err is the errno of a lock held by others.
+func busy(err error) bool {
+	return errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EACCES)
+}
+
+// interrupted reports whether err means that a wait was interrupted by a signal.
+func interrupted(err error) bool {
+	return errors.Is(err, unix.EINTR)
+}
+
+// kernelDeadlock reports whether err means that the kernel refused a wait that
+// would never end.
+func kernelDeadlock(err error) bool {
+	return errors.Is(err, unix.EDEADLK)
+}
+
+// exited reports whether the process pid no longer exists.
+func exited(pid int) bool {
+	return errors.Is(unix.Kill(pid, 0), unix.ESRCH)
+}
+
+func keyOf(fi os.FileInfo) fileKey {
+	st := fi.Sys().(*syscall.Stat_t)
+	return fileKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+}
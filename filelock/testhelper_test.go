@@ -1,10 +1,19 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
 package filelock
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"os/exec"
 	"strings"
 	"testing"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func TestHelperProcess(t *testing.T) {
@@ -26,23 +35,23 @@ func TestHelperProcess(t *testing.T) {
 
 	action := args[0]
 	path := args[1]
-	opts, hold := parseOptions(t, args[2:])
+	ho := parseOptions(t, args[2:])
+	opts, hold, rng := ho.lockOpts, ho.hold, ho.rng
 
-	l, err := New(path)
+	l, err := New(path, ho.newOpts...)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	switch action {
 	case "wlock":
-		err := l.WLock(opts...)
+		lock := l.WLock
+		if rng != nil {
+			lock = func(opts ...Option) error { return l.WLockRange(rng.Offset, rng.Length, opts...) }
+		}
+		err := lock(opts...)
 		if failed != "" {
-			if err == nil {
-				t.Fatalf("%v expected WLock failed with %q, got nil", args, failed)
-			}
-			if !strings.Contains(err.Error(), failed) {
-				t.Fatalf("%v expected WLock failed with %q, got %v", args, failed, err)
-			}
+			checkFailure(t, args, failed, err)
 			return
 		}
 		if err != nil {
@@ -50,19 +59,21 @@ func TestHelperProcess(t *testing.T) {
 		}
 
 		t.Logf("WLock acquired for %s, hold for %s", path, hold)
+		if ho.then != "" {
+			lockThen(t, ho, opts)
+		}
 		time.Sleep(hold)
 		if err := l.Unlock(); err != nil {
 			t.Fatalf("%v expected Unlock to succeed, got %v", args, err)
 		}
 	case "rlock":
-		err := l.RLock(opts...)
+		lock := l.RLock
+		if rng != nil {
+			lock = func(opts ...Option) error { return l.RLockRange(rng.Offset, rng.Length, opts...) }
+		}
+		err := lock(opts...)
 		if failed != "" {
-			if err == nil {
-				t.Fatalf("%v expected RLock failed with %q, got nil", args, failed)
-			}
-			if !strings.Contains(err.Error(), failed) {
-				t.Fatalf("%v expected RLock failed with %q, got %v", args, failed, err)
-			}
+			checkFailure(t, args, failed, err)
 			return
 		}
 		if err != nil {
@@ -79,13 +90,71 @@ func TestHelperProcess(t *testing.T) {
 	}
 }
 
-func parseOptions(tb testing.TB, args []string) ([]Option, time.Duration) {
+// lockThen write locks the path of the --then option, while the helper process
+// holds its first lock, and keeps it until the helper exits.
+func lockThen(t *testing.T, ho helperOptions, opts []Option) {
+	l, err := New(ho.then, ho.newOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WLock(opts...); err != nil {
+		t.Fatalf("expected WLock of %s to succeed, got %v", ho.then, err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+}
+
+// helperFailures are the errors the helper process can be told to expect with
+// FILELOCK_TEST_FAILED, by name.
+var helperFailures = map[string]error{
+	"timeout":  ErrTimeout,
+	"canceled": context.Canceled,
+	"deadline": context.DeadlineExceeded,
+	"eagain":   unix.EAGAIN,
+	"edeadlk":  unix.EDEADLK,
+}
+
+// checkFailure checks that the lock call of the helper process failed with a
+// *LockError matching the error named failed.
+func checkFailure(t *testing.T, args []string, failed string, err error) {
+	want, ok := helperFailures[failed]
+	if !ok {
+		t.Fatalf("Unknown failure: %s", failed)
+	}
+	if !errors.Is(err, want) {
+		t.Fatalf("%v expected lock to fail with %v, got %v", args, want, err)
+	}
+	var lockErr *LockError
+	if !errors.As(err, &lockErr) || lockErr.Path != args[1] {
+		t.Fatalf("%v expected a *LockError for %s, got %#v", args, args[1], err)
+	}
+}
+
+// helperOptions are the options parsed from the helper process arguments.
+type helperOptions struct {
+	newOpts  []Option      // options passed to New
+	lockOpts []Option      // options passed to the lock call
+	hold     time.Duration // how long to hold the lock
+	rng      *Range        // the range to lock, nil for the whole file
+	then     string        // a path to lock next, while holding the first lock
+}
+
+func parseOptions(tb testing.TB, args []string) helperOptions {
 	hold := 3 * time.Second
-	var opts []Option
+	var opts, newOpts []Option
+	var rng *Range
+	var then string
 	for _, arg := range args {
 		switch {
+		case arg == "--ofd":
+			newOpts = append(newOpts, WithOFD())
+		case arg == "--flock":
+			newOpts = append(newOpts, WithFlock())
+		case strings.HasPrefix(arg, "--label="):
+			opts = append(opts, WithLabel(strings.TrimPrefix(arg, "--label=")))
 		case arg == "--block":
 			opts = append(opts, WithBlock())
+		case arg == "--kernel":
+			opts = append(opts, WithKernelWait())
 		case arg == "--remove":
 			opts = append(opts, WithRemove())
 		case strings.HasPrefix(arg, "--timeout="):
@@ -100,14 +169,82 @@ func parseOptions(tb testing.TB, args []string) ([]Option, time.Duration) {
 			if err != nil {
 				tb.Fatal("Invalid hold duration: ", arg)
 			}
+		case strings.HasPrefix(arg, "--then="):
+			then = strings.TrimPrefix(arg, "--then=")
+		case strings.HasPrefix(arg, "--range="):
+			var offset, length int64
+			if _, err := fmt.Sscanf(strings.TrimPrefix(arg, "--range="), "%d:%d", &offset, &length); err != nil {
+				tb.Fatal("Invalid range: ", arg)
+			}
+			rng = &Range{Offset: offset, Length: length}
 		default:
 			tb.Fatal("Unknown option: ", arg)
 		}
 	}
 
-	return opts, hold
+	return helperOptions{newOpts: newOpts, lockOpts: opts, hold: hold, rng: rng, then: then}
 }
 
 func helperProcessArgs(args ...string) []string {
 	return append([]string{"-test.paniconexit0", "-test.timeout=10m0s", "-test.v=true", "-test.run=TestHelperProcess", "--"}, args...)
 }
+
+// startHelper runs the helper process with args and waits until it reports
+// that the lock has been acquired. The helper is waited for on cleanup.
+func startHelper(t *testing.T, args ...string) *exec.Cmd {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], helperProcessArgs(args...)...)
+	cmd.Env = append(os.Environ(), "FILELOCK_HELPER_PROCESS=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if strings.Contains(scanner.Text(), "acquired for") {
+				close(acquired)
+				break
+			}
+		}
+		// Drain the rest of the output so the helper never blocks on a full pipe.
+		for scanner.Scan() {
+		}
+		done <- cmd.Wait()
+	}()
+	t.Cleanup(func() {
+		if err := <-done; err != nil {
+			t.Errorf("helper %v: %v", args, err)
+		}
+	})
+
+	select {
+	case <-acquired:
+		return cmd
+	case err := <-done:
+		done <- err
+		t.Fatalf("helper %v exited before acquiring the lock", args)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("helper %v did not acquire the lock", args)
+	}
+	return nil
+}
+
+// runHelper runs the helper process with args to completion, expecting its lock
+// call to fail with the error named failed, as listed in helperFailures.
+func runHelper(t *testing.T, failed string, args ...string) {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], helperProcessArgs(args...)...)
+	cmd.Env = append(os.Environ(), "FILELOCK_HELPER_PROCESS=1", "FILELOCK_TEST_FAILED="+failed)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("helper %v: %v\n%s", args, err, out)
+	}
+}
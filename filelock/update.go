@@ -0,0 +1,126 @@
+package filelock
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// defaultFileMode is the permission of a file created by Update.
+const defaultFileMode fs.FileMode = 0o644
+
+// Update replaces the contents of path, which must be absolute, with the result of
+// fn applied to its current contents, while holding the write lock on path.
+//
+// fn receives nil if path does not exist yet. The result is written to a temporary
+// file in the same directory, synced, and renamed over path, and the directory is
+// synced in turn, so that readers and crashes see either the old contents or the
+// new ones in full. The new file keeps the permission of the old one. If fn fails,
+// path is left untouched and its error is returned.
+//
+// The lock is taken through an RWLock, so Update also excludes the other goroutines
+// of the process. The options are those of RWLock.WLock.
+func Update(path string, fn func(old []byte) ([]byte, error), opts ...Option) (err error) {
+	l, err := NewRWLock(path, opts...)
+	if err != nil {
+		return err
+	}
+	h, err := l.WLock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := h.Unlock(); uerr != nil {
+			err = errors.Join(err, uerr)
+		}
+	}()
+
+	perm := defaultFileMode
+	old, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		old = nil
+	case err != nil:
+		return err
+	default:
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		perm = fi.Mode().Perm()
+	}
+
+	data, err := fn(old)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data, perm)
+}
+
+// ReadLocked returns the contents of path, which must be absolute, read while
+// holding the read lock on path. It pairs with Update, whose writes it never
+// observes half done. The options are those of RWLock.RLock.
+func ReadLocked(path string, opts ...Option) (data []byte, err error) {
+	l, err := NewRWLock(path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	h, err := l.RLock()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if uerr := h.Unlock(); uerr != nil {
+			err = errors.Join(err, uerr)
+		}
+	}()
+
+	return os.ReadFile(path)
+}
+
+// writeFile atomically replaces the contents of path with data, through a synced
+// temporary file renamed over path, and syncs the directory.
+func writeFile(path string, data []byte, perm fs.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("syncing %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	committed = true
+
+	// Sync the directory so that the rename survives a crash.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("syncing %s: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package filelock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdate(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "counter")
+
+	_, err := ReadLocked(file)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// Concurrent updates of the process never lose a write.
+	increment := func(old []byte) ([]byte, error) {
+		n := 0
+		if old != nil {
+			var err error
+			if n, err = strconv.Atoi(string(old)); err != nil {
+				return nil, err
+			}
+		}
+		return []byte(strconv.Itoa(n + 1)), nil
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- Update(file, increment)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	data, err := ReadLocked(file)
+	require.NoError(t, err)
+	require.Equal(t, "10", string(data))
+
+	// A failed update leaves the file alone, keeping its permission.
+	require.NoError(t, os.Chmod(file, 0o600))
+	errFn := errors.New("update failed")
+	require.ErrorIs(t, Update(file, func([]byte) ([]byte, error) { return nil, errFn }), errFn)
+	require.NoError(t, Update(file, increment))
+
+	data, err = ReadLocked(file)
+	require.NoError(t, err)
+	require.Equal(t, "11", string(data))
+	fi, err := os.Stat(file)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	require.Equal(t, []string{"counter", "counter.lock"}, names)
+
+	require.ErrorIs(t, Update("counter", increment), ErrNotAbsolutePath)
+}
@@ -0,0 +1,80 @@
+//go:build linux && (amd64 || arm64 || loong64 || ppc64 || ppc64le || riscv64 || s390x)
+
+package filelock
+
+import (
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// interruptSignal is the signal sent to a thread waiting for a lock in the kernel
+// to make it give up the wait.
+//
+// The Go runtime handles realtime signals and ignores them unless they are requested
+// with os/signal, so programs that ask os/signal for this signal, or for every
+// signal, will see it too. WithKernelWait documents this, and WithBlock avoids it.
+const interruptSignal = unix.Signal(63)
+
+const (
+	sigDefault = 0          // SIG_DFL
+	sigIgnore  = 1          // SIG_IGN
+	saRestart  = 0x10000000 // SA_RESTART
+)
+
+// sigaction is the kernel struct sigaction on 64-bit architectures.
+type sigaction struct {
+	handler  uintptr
+	flags    uint64
+	restorer uintptr
+	mask     uint64
+}
+
+var interruptMu sync.Mutex
+
+// canInterrupt reports whether a thread waiting for a lock in the kernel can be
+// interrupted with interruptSignal.
+//
+// The runtime installs its handlers with SA_RESTART, which makes the kernel resume
+// F_SETLKW and flock after the handler runs. canInterrupt clears the flag for
+// interruptSignal, so that the wait fails with EINTR instead, and checks that the
+// signal is still handled rather than ignored or fatal.
+func canInterrupt() bool {
+	interruptMu.Lock()
+	defer interruptMu.Unlock()
+
+	var act sigaction
+	if rtSigaction(interruptSignal, nil, &act) != nil {
+		return false
+	}
+	if act.handler == sigDefault || act.handler == sigIgnore {
+		return false
+	}
+	if act.flags&saRestart != 0 {
+		act.flags &^= saRestart
+		if rtSigaction(interruptSignal, &act, nil) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// gettid returns the ID of the calling thread.
+func gettid() int {
+	return unix.Gettid()
+}
+
+// interrupt sends interruptSignal to the thread tid of the calling process.
+func interrupt(tid int) error {
+	return unix.Tgkill(unix.Getpid(), tid, interruptSignal)
+}
+
+func rtSigaction(sig unix.Signal, act, old *sigaction) error {
+	_, _, errno := unix.RawSyscall6(unix.SYS_RT_SIGACTION, uintptr(sig),
+		uintptr(unsafe.Pointer(act)), uintptr(unsafe.Pointer(old)), unsafe.Sizeof(act.mask), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
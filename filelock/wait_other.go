@@ -0,0 +1,13 @@
+//go:build !linux || !(amd64 || arm64 || loong64 || ppc64 || ppc64le || riscv64 || s390x)
+
+package filelock
+
+// canInterrupt reports whether a thread waiting for a lock in the kernel can be
+// interrupted. It cannot on this platform, so waits are polled instead.
+func canInterrupt() bool { return false }
+
+// gettid is never called where waits cannot be interrupted.
+func gettid() int { return 0 }
+
+// interrupt is never called where waits cannot be interrupted.
+func interrupt(int) error { return ErrUnsupported }